@@ -0,0 +1,118 @@
+package streisand
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+	"github.com/bertha/streisand/diskstore"
+)
+
+// Export writes all blobs whose digest starts with the hex encoded prefix to
+// w as a tar archive, from the stores of all hash algorithms. Entries are
+// named after the blobs' addresses, which for algorithms other than SHA-256
+// are multihashes. An empty prefix exports everything.
+func (s *server) Export(ctx context.Context, w io.Writer, prefix string) error {
+	p, bits, err := parseHexPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	// Blobs are never modified once written, so there's no need to hold
+	// any lock while streaming them.
+	tw := tar.NewWriter(w)
+	for _, hs := range s.sortedHashStores() {
+		algo := hs.algo
+		if err := hs.store.AppendTar(ctx, tw, p, bits, func(digest []byte) string {
+			return hex.EncodeToString(algo.key(digest))
+		}); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// Import stores every blob in a tar archive as written by Export, and returns
+// how many of them were new to this server. Entries are stored with the hash
+// algorithm of the address they're named after, or SHA-256 if their name
+// isn't an address.
+func (s *server) Import(ctx context.Context, r io.Reader) (added int, err error) {
+	err = diskstore.ReadTar(r, func(claimed []byte, contents io.Reader) error {
+		hs := s.hashStores[SHA256.Code]
+		if claimed != nil {
+			h, digest, err := s.lookup(normalizeKey(claimed))
+			if err != nil {
+				return fmt.Errorf("archive entry %s: %w", hex.EncodeToString(claimed), err)
+			}
+			hs, claimed = h, h.algo.key(digest)
+		}
+		hash, isNew, err := s.post(ctx, hs, ioutil.NopCloser(contents), nil)
+		if err != nil {
+			return err
+		}
+		if claimed != nil && !bytes.Equal(claimed, hash) {
+			return fmt.Errorf("archive entry %s has hash %s",
+				hex.EncodeToString(claimed), hex.EncodeToString(hash))
+		}
+		if isNew {
+			added++
+		}
+		return nil
+	})
+	return added, err
+}
+
+func (s *server) handleExport(r *http.Request) convreq.HttpResponse {
+	if r.Method != "GET" {
+		return respond.MethodNotAllowed("Method Not Allowed")
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if _, _, err := parseHexPrefix(prefix); err != nil {
+		return respond.BadRequest(err.Error())
+	}
+	hdrs := http.Header{}
+	hdrs.Set("Content-Type", "application/x-tar")
+	return respond.WithHeaders(respond.Handler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// The status has already been sent, so all we can do is
+			// truncate the archive, which tar readers will notice.
+			if err := s.Export(r.Context(), w, prefix); err != nil {
+				s.logger(r.Context()).Warn("export failed",
+					"prefix", prefix, "err", err)
+			}
+		})), hdrs)
+}
+
+func (s *server) handleImport(r *http.Request) convreq.HttpResponse {
+	if r.Method != "POST" {
+		return respond.MethodNotAllowed("Method Not Allowed")
+	}
+	added, err := s.Import(r.Context(), r.Body)
+	if err != nil {
+		return respond.Error(err)
+	}
+	return respond.String(fmt.Sprintf("%d new blobs\n", added))
+}
+
+// parseHexPrefix parses a hex encoded hash prefix that may have an odd number
+// of digits, and returns it together with its length in bits.
+func parseHexPrefix(prefix string) ([]byte, uint8, error) {
+	if len(prefix) >= 2*BytesPerHash {
+		return nil, 0, fmt.Errorf("prefix %q is too long", prefix)
+	}
+	bits := uint8(4 * len(prefix))
+	if len(prefix)%2 == 1 {
+		prefix += "0"
+	}
+	p, err := hex.DecodeString(prefix)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid prefix: %w", err)
+	}
+	return p, bits, nil
+}
@@ -0,0 +1,149 @@
+package streisand
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t testing.TB) Server {
+	s, err := NewServer(ServerConfig{
+		DataDir:   t.TempDir(),
+		CacheDir:  t.TempDir(),
+		WithFsync: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return s
+}
+
+func upload(t testing.TB, s Server, data string) string {
+	hash, err := tryUpload(s, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// tryUpload is like upload, but can be used outside of the test's goroutine.
+func tryUpload(s Server, data string) (string, error) {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/upload",
+		strings.NewReader(data)))
+	resp := w.Result()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("upload: %s", resp.Status)
+	}
+	hash, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func TestExportImport(t *testing.T) {
+	src := newTestServer(t)
+	dst := newTestServer(t)
+
+	blobs := []string{"test", "another test", "yet another test"}
+	hashes := make([]string, len(blobs))
+	for i, b := range blobs {
+		hashes[i] = upload(t, src, b)
+	}
+
+	w := httptest.NewRecorder()
+	src.ServeHTTP(w, httptest.NewRequest("GET", "/admin/export", nil))
+	if w.Code != 200 {
+		t.Fatalf("export: %d", w.Code)
+	}
+
+	w2 := httptest.NewRecorder()
+	dst.ServeHTTP(w2, httptest.NewRequest("POST", "/admin/import", w.Body))
+	if w2.Code != 200 {
+		t.Fatalf("import: %d: %s", w2.Code, w2.Body)
+	}
+	if got, want := w2.Body.String(), "3 new blobs\n"; got != want {
+		t.Errorf("import returned %q, want %q", got, want)
+	}
+
+	for i, h := range hashes {
+		w := httptest.NewRecorder()
+		dst.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+h, nil))
+		if w.Code != 200 {
+			t.Fatalf("GET %s: %d", h, w.Code)
+		}
+		if !bytes.Equal(w.Body.Bytes(), []byte(blobs[i])) {
+			t.Errorf("GET %s returned %q, want %q", h, w.Body, blobs[i])
+		}
+	}
+
+	// "test" hashes to 9f86..., so only that one matches this prefix.
+	w = httptest.NewRecorder()
+	src.ServeHTTP(w, httptest.NewRequest("GET", "/admin/export?prefix=9f8", nil))
+	dst2 := newTestServer(t)
+	w2 = httptest.NewRecorder()
+	dst2.ServeHTTP(w2, httptest.NewRequest("POST", "/admin/import", w.Body))
+	if got, want := w2.Body.String(), "1 new blobs\n"; got != want {
+		t.Errorf("import of prefix returned %q, want %q", got, want)
+	}
+}
+
+func TestExportImportHashAlgorithms(t *testing.T) {
+	newServer := func() Server {
+		s, err := NewServer(ServerConfig{
+			DataDir:        t.TempDir(),
+			CacheDir:       t.TempDir(),
+			HashAlgorithms: []*HashAlgorithm{SHA512},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			s.Close()
+		})
+		return s
+	}
+	src, dst := newServer(), newServer()
+
+	sha256Hash := upload(t, src, "sha-256")
+	w := httptest.NewRecorder()
+	src.ServeHTTP(w, httptest.NewRequest("POST", "/upload?hash="+SHA512.Name, strings.NewReader("sha-512")))
+	if w.Code != 200 {
+		t.Fatalf("upload: %d", w.Code)
+	}
+	sha512Hash := w.Body.String()
+
+	var archive bytes.Buffer
+	if err := src.(*server).Export(context.Background(), &archive, ""); err != nil {
+		t.Fatal(err)
+	}
+	if added, err := dst.(*server).Import(context.Background(), &archive); err != nil || added != 2 {
+		t.Fatalf("Import returned %d, %v", added, err)
+	}
+	for h, want := range map[string]string{sha256Hash: "sha-256", sha512Hash: "sha-512"} {
+		w := httptest.NewRecorder()
+		dst.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+h, nil))
+		if w.Code != 200 || w.Body.String() != want {
+			t.Errorf("GET %s returned %d: %q", h, w.Code, w.Body)
+		}
+	}
+
+	// A server without SHA-512 can't import those blobs.
+	archive.Reset()
+	if err := src.(*server).Export(context.Background(), &archive, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestServer(t).(*server).Import(context.Background(), &archive); err == nil {
+		t.Error("importing SHA-512 blobs into a server without SHA-512 succeeded")
+	}
+}
@@ -0,0 +1,270 @@
+package streisand
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An Authenticator decides whether a request may be served. It returns nil
+// to accept the request, or an error describing why it was rejected.
+type Authenticator interface {
+	Authenticate(r *http.Request) error
+}
+
+// AuthenticatorFunc adapts a function to an Authenticator.
+type AuthenticatorFunc func(r *http.Request) error
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) error {
+	return f(r)
+}
+
+// A RequestSigner adds credentials to an outgoing request to a peer.
+type RequestSigner func(req *http.Request) error
+
+var errNoCredentials = errors.New("no credentials")
+
+// AnyOf accepts a request if any of the given Authenticators accepts it.
+func AnyOf(auths ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) error {
+		err := errNoCredentials
+		for _, a := range auths {
+			if err = a.Authenticate(r); err == nil {
+				return nil
+			}
+		}
+		return err
+	})
+}
+
+// BearerTokens accepts requests with an "Authorization: Bearer <token>"
+// header that carries one of the given tokens.
+func BearerTokens(tokens ...string) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) error {
+		got := r.Header.Get("Authorization")
+		if !strings.HasPrefix(got, "Bearer ") {
+			return errNoCredentials
+		}
+		got = strings.TrimPrefix(got, "Bearer ")
+		for _, t := range tokens {
+			if subtle.ConstantTimeCompare([]byte(got), []byte(t)) == 1 {
+				return nil
+			}
+		}
+		return errors.New("invalid bearer token")
+	})
+}
+
+// BearerToken returns a RequestSigner for requests checked by BearerTokens.
+func BearerToken(token string) RequestSigner {
+	return func(req *http.Request) error {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+}
+
+// hmacMaxSkew is how far the timestamp of a signed request may be off.
+const hmacMaxSkew = 5 * time.Minute
+
+// contentSHA256Header carries the hex SHA-256 of the body of HMAC signed
+// requests.
+const contentSHA256Header = "X-StreiSANd-Content-SHA256"
+
+func hmacSignature(key []byte, method, uri string, ts int64, bodyDigest string) string {
+	m := hmac.New(sha256.New, key)
+	fmt.Fprintf(m, "%s\n%s\n%d\n%s", method, uri, ts, bodyDigest)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// HMACKeys accepts requests signed by HMACSigner with one of the given keys,
+// which are indexed by key ID. The signature covers the method, the request
+// URI, a timestamp and the SHA-256 of the body. Bodies can be large, so they
+// are checked as they're read: a body that doesn't match its signed digest
+// fails with errHashMismatch at its end.
+func HMACKeys(keys map[string][]byte) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) error {
+		got := r.Header.Get("Authorization")
+		if !strings.HasPrefix(got, "HMAC-SHA256 ") {
+			return errNoCredentials
+		}
+		parts := strings.Split(strings.TrimPrefix(got, "HMAC-SHA256 "), ":")
+		if len(parts) != 3 {
+			return errors.New("malformed HMAC authorization")
+		}
+		key, ok := keys[parts[0]]
+		if !ok {
+			return fmt.Errorf("unknown HMAC key %q", parts[0])
+		}
+		ts, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return errors.New("malformed HMAC timestamp")
+		}
+		if skew := time.Since(time.Unix(ts, 0)); skew > hmacMaxSkew || skew < -hmacMaxSkew {
+			return errors.New("HMAC timestamp out of range")
+		}
+		bodyDigest := r.Header.Get(contentSHA256Header)
+		want := hmacSignature(key, r.Method, r.URL.RequestURI(), ts, bodyDigest)
+		if !hmac.Equal([]byte(parts[2]), []byte(want)) {
+			return errors.New("invalid HMAC signature")
+		}
+		digest, err := hex.DecodeString(bodyDigest)
+		if err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("malformed %s", contentSHA256Header)
+		}
+		if r.Body != nil {
+			r.Body = &verifyingReader{ReadCloser: r.Body, h: sha256.New(), digest: digest}
+		}
+		return nil
+	})
+}
+
+// HMACSigner returns a RequestSigner for requests checked by HMACKeys. It
+// hashes bodies that can be replayed with GetBody; requests with other bodies
+// must set X-StreiSANd-Content-SHA256 themselves.
+func HMACSigner(keyID string, key []byte) RequestSigner {
+	return func(req *http.Request) error {
+		bodyDigest := req.Header.Get(contentSHA256Header)
+		if bodyDigest == "" {
+			var err error
+			if bodyDigest, err = bodySHA256(req); err != nil {
+				return err
+			}
+			req.Header.Set(contentSHA256Header, bodyDigest)
+		}
+		ts := time.Now().Unix()
+		sig := hmacSignature(key, req.Method, req.URL.RequestURI(), ts, bodyDigest)
+		req.Header.Set("Authorization", fmt.Sprintf("HMAC-SHA256 %s:%d:%s", keyID, ts, sig))
+		return nil
+	}
+}
+
+// bodySHA256 returns the hex SHA-256 of the body of req, which must be empty
+// or replayable.
+func bodySHA256(req *http.Request) (string, error) {
+	h := sha256.New()
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return "", fmt.Errorf("can't hash a streamed body without %s", contentSHA256Header)
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		defer body.Close()
+		if _, err := io.Copy(h, body); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// TLSClientNames accepts requests over TLS whose verified client
+// certificate has one of the given names as its common name or as a DNS
+// subject alternative name.
+func TLSClientNames(names ...string) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) error {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return errNoCredentials
+		}
+		cert := r.TLS.VerifiedChains[0][0]
+		for _, n := range names {
+			if cert.Subject.CommonName == n {
+				return nil
+			}
+			for _, dns := range cert.DNSNames {
+				if dns == n {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("client certificate %q is not allowed", cert.Subject.CommonName)
+	})
+}
+
+// authenticatorFor returns the Authenticator that guards path, or nil if
+// the path is open to everyone.
+func (s *server) authenticatorFor(path string) Authenticator {
+	switch {
+	case path == "/healthz", path == "/readyz", path == "/metrics":
+		return nil
+	case strings.HasPrefix(path, "/internal/"),
+		strings.HasPrefix(path, "/admin/"),
+		strings.HasPrefix(path, "/debug/"):
+		return s.conf.PeerAuth
+	default:
+		return s.conf.ClientAuth
+	}
+}
+
+// authenticate rejects requests that aren't accepted by the Authenticator
+// configured for their path.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a := s.authenticatorFor(r.URL.Path); a != nil {
+			if err := a.Authenticate(r); err != nil {
+				s.logger(r.Context()).Warn("rejected unauthenticated request",
+					"path", r.URL.Path, "remote", r.RemoteAddr, "err", err)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="streisand"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// digestedBody is a request body that carries its hex SHA-256, so that
+// requests with streamed bodies can be signed.
+type digestedBody struct {
+	io.Reader
+	digest string
+}
+
+// newPeerRequest creates a request to a peer, carrying the request ID from
+// ctx and signed with the configured peer credentials.
+func (s *server) newPeerRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := body.(digestedBody); ok {
+		req.Header.Set(contentSHA256Header, b.digest)
+	}
+	setRequestID(ctx, req)
+	if s.conf.PeerCredentials != nil {
+		if err := s.conf.PeerCredentials(req); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// peerContext returns a context for a request to a peer, which is canceled
+// after PeerTimeout.
+func (s *server) peerContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.conf.PeerTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.conf.PeerTimeout)
+}
+
+// cancelingBody cancels the context of a response when its body is closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,151 @@
+package streisand
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestClientAuth(t *testing.T) {
+	keys := map[string][]byte{"k1": []byte("hunter2")}
+	s, err := NewServer(ServerConfig{
+		DataDir:    t.TempDir(),
+		CacheDir:   t.TempDir(),
+		ClientAuth: AnyOf(BearerTokens("t0ken"), HMACKeys(keys)),
+		PeerAuth:   BearerTokens("peer-secret"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		sign   RequestSigner
+		status int
+	}{
+		{"no credentials", "/list", nil, 401},
+		{"bearer token", "/list", BearerToken("t0ken"), 200},
+		{"wrong bearer token", "/list", BearerToken("nope"), 401},
+		{"hmac", "/list", HMACSigner("k1", []byte("hunter2")), 200},
+		{"hmac with wrong key", "/list", HMACSigner("k1", []byte("nope")), 401},
+		{"hmac with unknown key", "/list", HMACSigner("k2", []byte("hunter2")), 401},
+		{"client token on internal", "/internal/blob/00", BearerToken("t0ken"), 401},
+		{"peer secret on internal", "/internal/blob/00", BearerToken("peer-secret"), 400},
+		{"healthz is open", "/healthz", nil, 200},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.sign != nil {
+			if err := tc.sign(req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, tc.status)
+		}
+	}
+}
+
+func TestHMACBody(t *testing.T) {
+	key := []byte("hunter2")
+	s, err := NewServer(ServerConfig{
+		DataDir:    t.TempDir(),
+		CacheDir:   t.TempDir(),
+		ClientAuth: HMACKeys(map[string][]byte{"k1": key}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	upload := func(body string, tamper func(req *http.Request)) int {
+		req, err := http.NewRequest("POST", "/upload", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := HMACSigner("k1", key)(req); err != nil {
+			t.Fatal(err)
+		}
+		tamper(req)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := upload("test", func(*http.Request) {}); code != 200 {
+		t.Errorf("signed upload returned %d", code)
+	}
+	if code := upload("test", func(req *http.Request) {
+		req.Body = io.NopCloser(strings.NewReader("evil"))
+	}); code != 400 {
+		t.Errorf("upload with a replaced body returned %d, want 400", code)
+	}
+	if code := upload("test", func(req *http.Request) {
+		sum := sha256.Sum256([]byte("evil"))
+		req.Header.Set("X-StreiSANd-Content-SHA256", hex.EncodeToString(sum[:]))
+		req.Body = io.NopCloser(strings.NewReader("evil"))
+	}); code != 401 {
+		t.Errorf("upload with a replaced body digest returned %d, want 401", code)
+	}
+}
+
+func TestPeerCredentials(t *testing.T) {
+	key := []byte("hunter2")
+	for _, tc := range []struct {
+		name string
+		auth Authenticator
+		sign RequestSigner
+	}{
+		{"bearer", BearerTokens("peer-secret"), BearerToken("peer-secret")},
+		{"hmac", HMACKeys(map[string][]byte{"k1": key}), HMACSigner("k1", key)},
+	} {
+		newServer := func() *server {
+			s, err := NewServer(ServerConfig{
+				DataDir:         t.TempDir(),
+				CacheDir:        t.TempDir(),
+				HashAlgorithms:  []*HashAlgorithm{BLAKE3},
+				PeerAuth:        tc.auth,
+				PeerCredentials: tc.sign,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s.(*server)
+		}
+		src := newServer()
+		dst := newServer()
+		ts := httptest.NewServer(dst)
+		defer ts.Close()
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, algo := range []*HashAlgorithm{SHA256, BLAKE3} {
+			hash, _, err := src.post(context.Background(), src.hashStores[algo.Code], io.NopCloser(strings.NewReader("test")), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := src.pushBlob(context.Background(), u, hash, "", nil); err != nil {
+				t.Fatalf("%s: pushBlob of %s blob: %v", tc.name, algo.Name, err)
+			}
+			hs, digest, err := dst.lookup(hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if has, err := hs.store.Has(digest); err != nil || !has {
+				t.Fatalf("%s: %s wasn't pushed: %v", tc.name, hex.EncodeToString(hash), err)
+			}
+		}
+	}
+}
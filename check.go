@@ -0,0 +1,227 @@
+package streisand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/bertha/streisand/diskstore"
+)
+
+// StartupCheck selects how NewServer verifies the xor trees against the
+// stores after an unclean shutdown. Wrong entries are repaired.
+type StartupCheck string
+
+const (
+	// CheckNone trusts the xor trees.
+	CheckNone StartupCheck = ""
+	// CheckTree recomputes the layers above the leaves from the leaves.
+	// It's fast, but doesn't compare the leaves with the stores.
+	CheckTree StartupCheck = "tree"
+	// CheckSample does CheckTree, and compares a random sample of leaves
+	// with the stores.
+	CheckSample StartupCheck = "sample"
+	// CheckFull does CheckTree, and compares all leaves with the stores.
+	// It reads every directory of the stores.
+	CheckFull StartupCheck = "full"
+)
+
+// startupCheckSamples is the number of leaves that CheckSample compares.
+const startupCheckSamples = 1024
+
+// fullCheckChunkBits is the length of the prefixes that CheckFull scans the
+// stores by, which bounds its memory use.
+const fullCheckChunkBits = 8
+
+// cleanShutdownMarker is the file in CacheDir that Close creates, and that
+// NewServer removes.
+const cleanShutdownMarker = "clean-shutdown"
+
+func (c StartupCheck) valid() bool {
+	switch c {
+	case CheckNone, CheckTree, CheckSample, CheckFull:
+		return true
+	}
+	return false
+}
+
+// consumeCleanShutdown returns whether the server was closed cleanly the last
+// time it ran, and removes the marker so that a crash is noticed next time.
+func (s *server) consumeCleanShutdown() (bool, error) {
+	path := filepath.Join(s.conf.CacheDir, cleanShutdownMarker)
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if s.conf.WithFsync {
+		if err := diskstore.SyncDir(s.conf.CacheDir); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// markCleanShutdown records that the stores were closed cleanly.
+func (s *server) markCleanShutdown() error {
+	return writeMarker(filepath.Join(s.conf.CacheDir, cleanShutdownMarker), s.conf.WithFsync)
+}
+
+// writeMarker creates an empty file at path.
+func writeMarker(path string, fsync bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if fsync {
+		return diskstore.SyncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// startupCheck verifies the xor tree of hs with check, repairs it, and
+// returns the number of entries that were wrong.
+func (s *server) startupCheck(hs *hashStore, check StartupCheck) (int, error) {
+	var (
+		repaired int
+		err      error
+	)
+	switch check {
+	case CheckNone:
+		return 0, nil
+	case CheckSample:
+		var wrong []Hash
+		if wrong, err = s.checkSampledLeaves(hs); err == nil {
+			repaired, err = hs.xors.RepairLeaves(wrong, hs.leaf(context.Background()))
+		}
+	case CheckFull:
+		repaired, err = s.repairAllLeaves(hs)
+	}
+	if err != nil {
+		return repaired, err
+	}
+	return repaired + hs.xors.RepairTree(), nil
+}
+
+// checkSampledLeaves returns the hashes of the leaves in a random sample that
+// don't match the store.
+func (s *server) checkSampledLeaves(hs *hashStore) ([]Hash, error) {
+	depth := uint(hs.xors.Depth())
+	var wrong []Hash
+	for i := 0; i < startupCheckSamples; i++ {
+		h := hashWithPrefix(uint32(rand.Int63n(1<<depth)), depth)
+		want, err := hs.computeLeaf(context.Background(), &h)
+		if err != nil {
+			return nil, err
+		}
+		if got := hs.xors.GetLeaf(&h); !got.Equals(&want) {
+			wrong = append(wrong, h)
+		}
+	}
+	return wrong, nil
+}
+
+// repairAllLeaves compares all leaves with the store and repairs the ones
+// that are wrong, one chunk at a time. It returns the number of leaves that
+// were wrong.
+func (s *server) repairAllLeaves(hs *hashStore) (int, error) {
+	depth := uint(hs.xors.Depth())
+	chunkBits := uint(fullCheckChunkBits)
+	if chunkBits > depth {
+		chunkBits = depth
+	}
+	repaired := 0
+	for chunk := uint32(0); chunk < 1<<chunkBits; chunk++ {
+		prefix := hashWithPrefix(chunk, chunkBits)
+		sums := map[uint32]Hash{}
+		if err := hs.store.Scan(context.Background(), prefix[:], uint8(chunkBits), func(digest []byte) {
+			x := xorHash(digest)
+			sum := sums[x.PrefixToNumber(depth)]
+			x.XorInto(sum[:])
+			sums[x.PrefixToNumber(depth)] = sum
+		}); err != nil {
+			return repaired, err
+		}
+		var wrong []Hash
+		first := chunk << (depth - chunkBits)
+		for idx := first; idx < first+1<<(depth-chunkBits); idx++ {
+			h := hashWithPrefix(idx, depth)
+			want := sums[idx]
+			if got := hs.xors.GetLeaf(&h); !got.Equals(&want) {
+				wrong = append(wrong, h)
+			}
+		}
+		n, err := hs.xors.RepairLeaves(wrong, func(h *Hash) (Hash, error) {
+			return sums[h.PrefixToNumber(depth)], nil
+		})
+		repaired += n
+		if err != nil {
+			return repaired, err
+		}
+	}
+	return repaired, nil
+}
+
+// checkStores runs the startup check on all hash stores if the server wasn't
+// closed cleanly, and rebuilds xor trees that were lost.
+func (s *server) checkStores() error {
+	clean, err := s.consumeCleanShutdown()
+	if err != nil {
+		return fmt.Errorf("clean shutdown marker: %w", err)
+	}
+	warned := false
+	for _, hs := range s.sortedHashStores() {
+		check := s.conf.StartupCheck
+		if hs.xors.NeedsRebuild() {
+			if hs.xors.Created() {
+				// The new layers are empty, which is right if
+				// the store is too.
+				blobs, _, err := hs.store.Usage(context.Background())
+				if err != nil {
+					return fmt.Errorf("%s: %w", hs.algo.Name, err)
+				}
+				if blobs == 0 {
+					if err := hs.xors.Rebuilt(); err != nil {
+						return fmt.Errorf("%s: %w", hs.algo.Name, err)
+					}
+					continue
+				}
+			}
+			s.log.Warn("xor tree is missing or has another geometry, rebuilding it", "algorithm", hs.algo.Name)
+			check = CheckFull
+		} else if clean {
+			continue
+		} else if !warned {
+			s.log.Warn("server wasn't shut down cleanly", "check", string(check))
+			warned = true
+		}
+		start := time.Now()
+		n, err := s.startupCheck(hs, check)
+		if err != nil {
+			return fmt.Errorf("%s: checking xor tree: %w", hs.algo.Name, err)
+		}
+		if hs.xors.NeedsRebuild() {
+			if err := hs.xors.Rebuilt(); err != nil {
+				return fmt.Errorf("%s: %w", hs.algo.Name, err)
+			}
+		} else {
+			atomic.AddUint64(&s.metrics.xorRepairs, uint64(n))
+		}
+		if n > 0 {
+			s.log.Warn("repaired xor tree", "algorithm", hs.algo.Name, "entries", n, "duration", time.Since(start))
+		} else if check != CheckNone {
+			s.log.Info("xor tree is consistent", "algorithm", hs.algo.Name, "duration", time.Since(start))
+		}
+	}
+	return nil
+}
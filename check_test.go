@@ -0,0 +1,93 @@
+package streisand
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanShutdownMarker(t *testing.T) {
+	conf := ServerConfig{DataDir: t.TempDir(), CacheDir: t.TempDir()}
+	marker := filepath.Join(conf.CacheDir, cleanShutdownMarker)
+
+	s, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("marker exists while running: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("no marker after Close: %v", err)
+	}
+
+	s, err = NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("marker wasn't removed at startup: %v", err)
+	}
+}
+
+func TestStartupCheck(t *testing.T) {
+	for _, tc := range []struct {
+		check   StartupCheck
+		corrupt func(xs *XorStore, h *Hash)
+		clean   bool
+		want    bool
+	}{
+		// A wrong leaf (and its ancestors) is found by a full check.
+		{check: CheckFull, corrupt: func(xs *XorStore, h *Hash) { xs.Add(h) }, want: true},
+		// A wrong upper layer is found by checking the tree.
+		{check: CheckTree, corrupt: func(xs *XorStore, h *Hash) { xs.layers[0].Add(h) }, want: true},
+		// Nothing is checked after a clean shutdown.
+		{check: CheckFull, corrupt: func(xs *XorStore, h *Hash) { xs.Add(h) }, clean: true},
+		{check: CheckNone, corrupt: func(xs *XorStore, h *Hash) { xs.Add(h) }},
+	} {
+		t.Run(string(tc.check), func(t *testing.T) {
+			conf := ServerConfig{DataDir: t.TempDir(), CacheDir: t.TempDir(), StartupCheck: tc.check}
+			s, err := NewServer(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range []string{"a", "b", "c"} {
+				upload(t, s, b)
+			}
+			bogus := &Hash{0xab, 0xcd}
+			tc.corrupt(s.(*server).xors, bogus)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !tc.clean {
+				os.Remove(filepath.Join(conf.CacheDir, cleanShutdownMarker))
+			}
+
+			s, err = NewServer(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			xs := s.(*server).xors
+			want, err := s.(*server).hashStores[SHA256.Code].computeLeaf(context.Background(), bogus)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf := xs.GetLeaf(bogus)
+			repaired := leaf.Equals(&want)
+			for i := len(xs.layers) - 2; i >= 0; i-- {
+				if xs.recompute(i, bogus.PrefixToNumber(xs.layers[i].PrefixLength)) {
+					repaired = false
+				}
+			}
+			if repaired != tc.want {
+				t.Errorf("repaired = %v, want %v", repaired, tc.want)
+			}
+		})
+	}
+}
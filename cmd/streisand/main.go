@@ -0,0 +1,191 @@
+// Binary streisand runs a StreiSANd server.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bertha/streisand"
+)
+
+var (
+	listen    = flag.String("listen", ":8080", "address to listen on")
+	dataDir   = flag.String("data", "data", "directory to store blobs in")
+	cacheDir  = flag.String("cache", "cache", "directory to store the xor tree in")
+	peers     = flag.String("peers", "", "comma separated list of peer URLs, like https://peer1:8080")
+	peersFile = flag.String("peers-file", "", "file with a peer URL per line, reread when it changes")
+	peersSRV  = flag.String("peers-srv", "", "DNS SRV name to look up peers with, like _streisand._tcp.example.com")
+	seeds     = flag.String("gossip-seeds", "", "comma separated list of peer URLs to join the cluster through with gossip")
+	scheme    = flag.String("peer-scheme", "http", "scheme of the peer URLs found through -peers-srv")
+	self      = flag.String("self", "", "URL under which the peers know this node; required for write concerns above local")
+	replicas  = flag.Int("replicas", 0, "number of nodes to store each blob on, or 0 for all of them")
+	fsync     = flag.Bool("fsync", true, "whether to fsync blobs before acknowledging them")
+	debug     = flag.Bool("debug", false, "enable debug logging and endpoints")
+	scrubInt  = flag.Duration("scrub-interval", 0, "time between passes of the scrubber over all blobs, or 0 to disable scrubbing")
+	scrubRate = flag.Int64("scrub-rate", 10<<20, "bytes per second the scrubber reads")
+	hashAlgos = flag.String("hash-algorithms", "", "comma separated list of hash algorithms clients may use besides sha2-256, like blake3,sha2-512")
+	verify    = flag.Bool("verify-on-read", false, "check blobs against their hash while serving them")
+	layers    = flag.Int("xor-layers", 6, "number of layers of the xor tree")
+	depth     = flag.Int("xor-layer-depth", 4, "bits of prefix that each layer of the xor tree adds")
+	sparse    = flag.Bool("sparse-xors", false, "keep the xor tree in memory, sized by the number of blobs instead of its depth")
+	folders   = flag.String("bits-per-folder", "8,8", "comma separated bits of the hash per directory level of the store")
+	check     = flag.String("startup-check", "sample", "how to verify the xor trees after an unclean shutdown: none, tree, sample or full")
+	readTO    = flag.Duration("read-timeout", 0, "maximum time to read a request, including an uploaded blob, or 0 for no limit")
+	writeTO   = flag.Duration("write-timeout", 0, "maximum time to write a response, including a downloaded blob, or 0 for no limit")
+	peerTO    = flag.Duration("peer-timeout", 0, "maximum time of a request to a peer, including the blob transfer, or 0 for no limit")
+	tlsCA     = flag.String("tls-ca", "", "PEM file with the CAs that sign peer certificates")
+	tlsCert   = flag.String("tls-cert", "", "PEM file with this node's certificate; enables serving TLS")
+	tlsKey    = flag.String("tls-key", "", "PEM file with this node's key")
+)
+
+func main() {
+	flag.Parse()
+
+	var getPeers streisand.PeersFunc
+	var gossip *streisand.GossipConfig
+	switch {
+	case *peersFile != "":
+		getPeers = streisand.FilePeers(*peersFile)
+	case *peersSRV != "":
+		getPeers = streisand.DNSSRVPeers(*scheme, *peersSRV)
+	case *seeds != "":
+		seedURLs, err := streisand.ParsePeers(*seeds)
+		if err != nil {
+			log.Fatalf("-gossip-seeds: %v", err)
+		}
+		gossip = &streisand.GossipConfig{Seeds: seedURLs}
+	default:
+		peerURLs, err := streisand.ParsePeers(*peers)
+		if err != nil {
+			log.Fatalf("-peers: %v", err)
+		}
+		getPeers = streisand.StaticPeers(peerURLs...)
+	}
+
+	var selfURL *url.URL
+	if *self != "" {
+		var err error
+		if selfURL, err = url.Parse(*self); err != nil {
+			log.Fatalf("invalid -self URL %q: %v", *self, err)
+		}
+	}
+	var placement *streisand.Placement
+	if *replicas > 0 {
+		if selfURL == nil {
+			log.Fatalf("-replicas requires -self")
+		}
+		placement = &streisand.Placement{Replicas: *replicas}
+	}
+
+	var algos []*streisand.HashAlgorithm
+	for _, name := range strings.FieldsFunc(*hashAlgos, func(r rune) bool { return r == ',' }) {
+		a, ok := streisand.LookupHashAlgorithm(name)
+		if !ok {
+			log.Fatalf("-hash-algorithms: unknown algorithm %q", name)
+		}
+		algos = append(algos, a)
+	}
+
+	var bitsPerFolder []uint8
+	for _, f := range strings.Split(*folders, ",") {
+		n, err := strconv.ParseUint(f, 10, 8)
+		if err != nil {
+			log.Fatalf("-bits-per-folder: %v", err)
+		}
+		bitsPerFolder = append(bitsPerFolder, uint8(n))
+	}
+
+	startupCheck := streisand.StartupCheck(*check)
+	if *check == "none" {
+		startupCheck = streisand.CheckNone
+	}
+
+	var scrub *streisand.ScrubConfig
+	if *scrubInt > 0 {
+		scrub = &streisand.ScrubConfig{Interval: *scrubInt, BytesPerSecond: *scrubRate}
+	}
+
+	files := streisand.TLSFiles{
+		CAFile:   *tlsCA,
+		CertFile: *tlsCert,
+		KeyFile:  *tlsKey,
+	}
+	clientTLS, err := files.ClientConfig()
+	if err != nil {
+		log.Fatalf("loading TLS client config: %v", err)
+	}
+
+	s, err := streisand.NewServer(streisand.ServerConfig{
+		DataDir:        *dataDir,
+		CacheDir:       *cacheDir,
+		WithFsync:      *fsync,
+		Debug:          *debug,
+		HTTPClient:     streisand.NewPeerClient(clientTLS),
+		Self:           selfURL,
+		Placement:      placement,
+		GetPeers:       getPeers,
+		Gossip:         gossip,
+		Scrub:          scrub,
+		VerifyOnRead:   *verify,
+		HashAlgorithms: algos,
+		StartupCheck:   startupCheck,
+		LayerCount:     *layers,
+		LayerDepth:     *depth,
+		SparseXors:     *sparse,
+		PeerTimeout:    *peerTO,
+		BitsPerFolder:  bitsPerFolder,
+	})
+	if err != nil {
+		log.Fatalf("starting server: %v", err)
+	}
+
+	hs := &http.Server{
+		Addr:         *listen,
+		Handler:      s,
+		ReadTimeout:  *readTO,
+		WriteTimeout: *writeTO,
+	}
+	// Shut down cleanly on SIGINT and SIGTERM, so that the next start can
+	// skip the startup check.
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := hs.Shutdown(ctx); err != nil {
+			log.Printf("shutting down: %v", err)
+		}
+	}()
+	if *tlsCert != "" {
+		hs.TLSConfig, err = files.ServerConfig()
+		if err != nil {
+			log.Fatalf("loading TLS server config: %v", err)
+		}
+		err = hs.ListenAndServeTLS("", "")
+	} else {
+		err = hs.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		<-shutdown
+	} else {
+		log.Printf("serving: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		log.Fatalf("closing server: %v", err)
+	}
+	if err != http.ErrServerClosed {
+		os.Exit(1)
+	}
+}
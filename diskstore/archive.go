@@ -0,0 +1,83 @@
+package diskstore
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/hex"
+	"io"
+	"path"
+)
+
+// AppendTar adds all blobs whose hash matches the first bits of prefix to tw,
+// which it doesn't close, so that several stores can be written into one
+// archive. Every entry is named with name, which gets the hash of its
+// contents. It stops with ctx's error when ctx is done.
+func (s *Store) AppendTar(ctx context.Context, tw *tar.Writer, prefix []byte, bits uint8, name func(hash []byte) string) error {
+	// Collect the hashes first, because Scan's callback can't return errors.
+	var hashes [][]byte
+	if err := s.Scan(ctx, prefix, bits, func(h []byte) {
+		hashes = append(hashes, h)
+	}); err != nil {
+		return err
+	}
+
+	for _, h := range hashes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.writeTarEntry(tw, h, name(h)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) writeTarEntry(tw *tar.Writer, hash []byte, name string) error {
+	fh, err := s.Get(hash)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	st, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     st.Size(),
+		Mode:     0644,
+		ModTime:  st.ModTime(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, fh)
+	return err
+}
+
+// ReadTar reads a tar archive as written by AppendTar and calls callback for
+// every regular file in it. The callback gets the hash the entry claims to
+// have (nil if its name isn't a valid hash) and a reader for its contents,
+// which is only valid until the callback returns.
+func ReadTar(r io.Reader, callback func(claimed []byte, contents io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		claimed, err := hex.DecodeString(path.Base(hdr.Name))
+		if err != nil {
+			claimed = nil
+		}
+		if err := callback(claimed, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -2,9 +2,11 @@ package diskstore
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"hash"
 	"io"
 	"io/fs"
@@ -12,6 +14,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/icza/bitio"
 )
@@ -20,6 +24,9 @@ type Store struct {
 	Fsync         bool
 	Path          string
 	BitsPerFolder []uint8
+	// Hash creates the hash that blobs are stored under. It defaults to
+	// SHA-256.
+	Hash func() hash.Hash
 
 	minBytes int
 }
@@ -78,7 +85,11 @@ func (s *Store) NewWriter() (*Writer, error) {
 	if err != nil {
 		return nil, err
 	}
-	h := sha256.New()
+	newHash := s.Hash
+	if newHash == nil {
+		newHash = sha256.New
+	}
+	h := newHash()
 	mw := io.MultiWriter(fh, h)
 	return &Writer{
 		s:            s,
@@ -115,7 +126,6 @@ func (w *Writer) Close() error {
 		w.result = sum
 		return nil
 	}
-	dirs := w.s.DirsFor(sum)
 	if w.s.Fsync {
 		if err := w.fh.Sync(); err != nil {
 			return err
@@ -128,21 +138,8 @@ func (w *Writer) Close() error {
 	// TODO: Add synchronization in case the directories were just created and haven't been synced yet.
 	if err := os.Rename(w.fh.Name(), fullPath); err != nil {
 		// Create parent directories first.
-		p := w.s.Path
-		for _, d := range dirs {
-			prevP := p
-			p = filepath.Join(p, d)
-			if err := os.Mkdir(p, 0777); err != nil {
-				if os.IsExist(err) {
-					continue
-				}
-				return err
-			}
-			if w.s.Fsync {
-				if err := syncDir(prevP); err != nil {
-					return err
-				}
-			}
+		if err := w.s.mkdirs(sum); err != nil {
+			return err
 		}
 
 		if err := os.Rename(w.fh.Name(), fullPath); err != nil {
@@ -153,7 +150,7 @@ func (w *Writer) Close() error {
 	w.newlyWritten = true
 	w.needsRemoval = false
 	if w.s.Fsync {
-		if err := syncDir(filepath.Dir(fullPath)); err != nil {
+		if err := SyncDir(filepath.Dir(fullPath)); err != nil {
 			return err
 		}
 	}
@@ -161,6 +158,33 @@ func (w *Writer) Close() error {
 	return nil
 }
 
+// mkdirs creates the parent directories of hash.
+func (s *Store) mkdirs(hash []byte) error {
+	p := s.Path
+	for _, d := range s.DirsFor(hash) {
+		prevP := p
+		p = filepath.Join(p, d)
+		if err := os.Mkdir(p, 0777); err != nil {
+			if os.IsExist(err) {
+				continue
+			}
+			return err
+		}
+		if s.Fsync {
+			if err := SyncDir(prevP); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Sum returns the hash of everything written so far, without closing the
+// Writer.
+func (w *Writer) Sum() []byte {
+	return w.hasher.Sum(nil)
+}
+
 func (w *Writer) Hash() []byte {
 	if w.result == nil {
 		panic("blobstorage.Writer.Hash() called without successful Close()")
@@ -186,7 +210,9 @@ func (w *Writer) Abort() {
 	}
 }
 
-func syncDir(dirName string) error {
+// SyncDir fsyncs a directory, so that entries that were created, renamed or
+// removed in it are durable.
+func SyncDir(dirName string) error {
 	dh, err := os.Open(dirName)
 	if err != nil {
 		return err
@@ -219,7 +245,9 @@ func (s *Store) Has(hash []byte) (bool, error) {
 	return true, nil
 }
 
-func (s *Store) Scan(prefix []byte, bits uint8, callback func(hash []byte)) error {
+// Scan calls callback with the hash of every blob whose hash matches the first
+// bits of prefix. It stops with ctx's error when ctx is done.
+func (s *Store) Scan(ctx context.Context, prefix []byte, bits uint8, callback func(hash []byte)) error {
 	base := s.Path
 	if base == "" {
 		base = "."
@@ -235,6 +263,9 @@ func (s *Store) Scan(prefix []byte, bits uint8, callback func(hash []byte)) erro
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if path == base {
 			return nil
 		}
@@ -245,6 +276,10 @@ func (s *Store) Scan(prefix []byte, bits uint8, callback func(hash []byte)) erro
 		var enc string
 		if d.IsDir() {
 			enc = strings.ReplaceAll(path, "/", "")
+			// Folders of 4 bits make for an odd number of digits.
+			if len(enc)%2 == 1 {
+				enc += "0"
+			}
 		} else {
 			enc = d.Name()
 		}
@@ -256,7 +291,15 @@ func (s *Store) Scan(prefix []byte, bits uint8, callback func(hash []byte)) erro
 			}
 			return nil
 		}
-		if !compareBits(prefix, h, bitsAtDepth[strings.Count(path, "/")]) {
+		depth := strings.Count(path, "/")
+		if d.IsDir() != (depth < len(s.BitsPerFolder)) {
+			// Ignore temporary files from NewWriter and stray directories.
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !compareBits(prefix, h, bitsAtDepth[depth]) {
 			if d.IsDir() {
 				return fs.SkipDir
 			}
@@ -290,3 +333,139 @@ func compareBits(a, b []byte, bits uint8) bool {
 	}
 	return true
 }
+
+// Usage returns the number of blobs in the store and their total size. It
+// stops with ctx's error when ctx is done.
+func (s *Store) Usage(ctx context.Context) (blobs, size int64, err error) {
+	err = s.Scan(ctx, nil, 0, func(hash []byte) {
+		st, err := os.Stat(s.FullPath(hash))
+		if err != nil {
+			return
+		}
+		blobs++
+		size += st.Size()
+	})
+	return blobs, size, err
+}
+
+// CheckWritable verifies that new files can be written to the store, by
+// writing and syncing a small temporary file.
+func (s *Store) CheckWritable() (retErr error) {
+	fh, err := os.CreateTemp(s.Path, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(fh.Name()); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	if _, err := fh.Write([]byte{0}); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// FreeSpace returns the number of bytes available to unprivileged users on
+// the filesystem that holds the store.
+func (s *Store) FreeSpace() (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(s.Path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// Mark creates an empty file for hash and returns whether it didn't exist
+// yet. It allows a Store to be used as a set of hashes.
+func (s *Store) Mark(hash []byte) (bool, error) {
+	if !s.HasEnoughBits(hash) {
+		return false, errors.New("hash is too short")
+	}
+	fullPath := s.FullPath(hash)
+	create := func() (*os.File, error) {
+		return os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	}
+	fh, err := create()
+	if os.IsNotExist(err) {
+		if err := s.mkdirs(hash); err != nil {
+			return false, err
+		}
+		fh, err = create()
+	}
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := fh.Close(); err != nil {
+		return false, err
+	}
+	if s.Fsync {
+		if err := SyncDir(filepath.Dir(fullPath)); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// QuarantineDir is the directory in the store's Path that Quarantine moves
+// blobs to. Scan skips it.
+const QuarantineDir = "quarantine"
+
+// Quarantine moves the blob with the given hash out of the store and into
+// QuarantineDir, so that it can be inspected later. It returns the size of
+// the quarantined file.
+func (s *Store) Quarantine(hash []byte) (int64, error) {
+	fullPath := s.FullPath(hash)
+	st, err := os.Stat(fullPath)
+	if err != nil {
+		return 0, err
+	}
+	dir := filepath.Join(s.Path, QuarantineDir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return 0, err
+	}
+	// Keep earlier quarantined copies around.
+	name := fmt.Sprintf("%x.%d", hash, time.Now().UnixNano())
+	if err := os.Rename(fullPath, filepath.Join(dir, name)); err != nil {
+		return 0, err
+	}
+	if s.Fsync {
+		if err := SyncDir(filepath.Dir(fullPath)); err != nil {
+			return 0, err
+		}
+		if err := SyncDir(dir); err != nil {
+			return 0, err
+		}
+	}
+	return st.Size(), nil
+}
+
+// Delete removes the blob with the given hash and its metadata from the
+// store. It returns the size of the removed blob.
+func (s *Store) Delete(hash []byte) (int64, error) {
+	fullPath := s.FullPath(hash)
+	st, err := os.Stat(fullPath)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Remove(fullPath); err != nil {
+		return 0, err
+	}
+	if err := os.Remove(fullPath + metaSuffix); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if s.Fsync {
+		if err := SyncDir(filepath.Dir(fullPath)); err != nil {
+			return 0, err
+		}
+	}
+	return st.Size(), nil
+}
@@ -0,0 +1,170 @@
+package diskstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LayoutFile is the file in the root of a store that records the
+// BitsPerFolder it was written with. Scan ignores it, because its name isn't
+// valid hex.
+const LayoutFile = "layout"
+
+// LegacyBitsPerFolder is assumed for stores without a LayoutFile.
+var LegacyBitsPerFolder = []uint8{8, 8}
+
+// Migrate moves all blobs to the directories that s.BitsPerFolder puts them
+// in, if the store was written with another layout, and records the layout.
+// It returns the number of blobs that were moved. An interrupted migration
+// is resumed by calling Migrate again.
+func (s *Store) Migrate() (int, error) {
+	from, err := s.readLayout()
+	if err != nil {
+		return 0, err
+	}
+	recorded := from != nil
+	if !recorded {
+		from = LegacyBitsPerFolder
+	}
+	if equalBits(from, s.BitsPerFolder) {
+		if recorded {
+			return 0, nil
+		}
+		return 0, s.writeLayout()
+	}
+	moved, err := s.Reshard(from)
+	if err != nil {
+		return moved, err
+	}
+	return moved, s.writeLayout()
+}
+
+// Reshard moves all blobs that are stored in the layout given by from to
+// their directories in the layout of s, and returns how many it moved.
+func (s *Store) Reshard(from []uint8) (int, error) {
+	old := &Store{Path: s.Path, BitsPerFolder: from}
+	old.Initialize()
+	var hashes [][]byte
+	if err := old.Scan(context.Background(), nil, 0, func(hash []byte) {
+		hashes = append(hashes, append([]byte(nil), hash...))
+	}); err != nil {
+		return 0, err
+	}
+	moved := 0
+	oldDirs := map[string]bool{}
+	newDirs := map[string]bool{}
+	for _, hash := range hashes {
+		src, dst := old.FullPath(hash), s.FullPath(hash)
+		if src == dst {
+			continue
+		}
+		if err := s.mkdirs(hash); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// It was found in the new layout.
+				continue
+			}
+			return moved, err
+		}
+		if err := os.Rename(src+metaSuffix, dst+metaSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return moved, err
+		}
+		for d := filepath.Dir(src); d != s.Path && d != "."; d = filepath.Dir(d) {
+			oldDirs[d] = true
+		}
+		newDirs[filepath.Dir(dst)] = true
+		moved++
+	}
+	if s.Fsync {
+		for d := range newDirs {
+			if err := SyncDir(d); err != nil {
+				return moved, err
+			}
+		}
+	}
+	// Remove the old directories that are now empty, deepest first.
+	dirs := make([]string, 0, len(oldDirs))
+	for d := range oldDirs {
+		dirs = append(dirs, d)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(dirs[i]) > len(dirs[j])
+	})
+	for _, d := range dirs {
+		os.Remove(d)
+	}
+	return moved, nil
+}
+
+func (s *Store) readLayout() ([]uint8, error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.Path, LayoutFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bits []uint8
+	for _, f := range strings.Split(strings.TrimSpace(string(b)), ",") {
+		n, err := strconv.ParseUint(f, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", LayoutFile, err)
+		}
+		bits = append(bits, uint8(n))
+	}
+	return bits, nil
+}
+
+func (s *Store) writeLayout() error {
+	fields := make([]string, len(s.BitsPerFolder))
+	for i, n := range s.BitsPerFolder {
+		fields[i] = strconv.Itoa(int(n))
+	}
+	path := filepath.Join(s.Path, LayoutFile)
+	fh, err := ioutil.TempFile(s.Path, LayoutFile+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	if _, err := fh.WriteString(strings.Join(fields, ",") + "\n"); err != nil {
+		fh.Close()
+		return err
+	}
+	if s.Fsync {
+		if err := fh.Sync(); err != nil {
+			fh.Close()
+			return err
+		}
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(fh.Name(), path); err != nil {
+		return err
+	}
+	if s.Fsync {
+		return SyncDir(s.Path)
+	}
+	return nil
+}
+
+func equalBits(a, b []uint8) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package diskstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	s := &Store{Path: dir, BitsPerFolder: []uint8{8, 8}}
+	s.Initialize()
+	var hashes [][]byte
+	for _, data := range []string{"a", "b", "c"} {
+		w, err := s.NewWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, w.Hash())
+	}
+	if err := s.WriteMeta(hashes[0], []byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A store without a layout file has the legacy layout.
+	s = &Store{Path: dir, BitsPerFolder: []uint8{4, 4, 4}}
+	s.Initialize()
+	moved, err := s.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != len(hashes) {
+		t.Errorf("Migrate moved %d blobs, want %d", moved, len(hashes))
+	}
+	for _, h := range hashes {
+		if _, err := os.Stat(s.FullPath(h)); err != nil {
+			t.Error(err)
+		}
+	}
+	if md, err := s.ReadMeta(hashes[0]); err != nil || !bytes.Equal(md, []byte("meta")) {
+		t.Errorf("ReadMeta after Migrate: %q, %v", md, err)
+	}
+	layout, err := ioutil.ReadFile(filepath.Join(dir, LayoutFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(layout) != "4,4,4\n" {
+		t.Errorf("layout file is %q", layout)
+	}
+	// The old directories were removed.
+	old := &Store{Path: dir, BitsPerFolder: LegacyBitsPerFolder}
+	if _, err := os.Stat(filepath.Dir(old.FullPath(hashes[1]))); !os.IsNotExist(err) {
+		t.Errorf("old directory still exists: %v", err)
+	}
+
+	// Migrating again is a no-op.
+	if moved, err := s.Migrate(); err != nil || moved != 0 {
+		t.Errorf("second Migrate: %d, %v", moved, err)
+	}
+	var found int
+	if err := s.Scan(context.Background(), nil, 0, func([]byte) { found++ }); err != nil {
+		t.Fatal(err)
+	}
+	if found != len(hashes) {
+		t.Errorf("Scan found %d blobs, want %d", found, len(hashes))
+	}
+}
@@ -0,0 +1,58 @@
+package diskstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// metaSuffix is appended to the path of a blob to get the path of its
+// sidecar. Scan ignores sidecars, because their names aren't valid hex.
+const metaSuffix = ".meta"
+
+// WriteMeta stores data in a sidecar file next to the blob with the given
+// hash, replacing the previous sidecar. The blob itself doesn't need to
+// exist yet.
+func (s *Store) WriteMeta(hash, data []byte) (retErr error) {
+	if !s.HasEnoughBits(hash) {
+		return errors.New("hash is too short")
+	}
+	if err := s.mkdirs(hash); err != nil {
+		return err
+	}
+	fullPath := s.FullPath(hash) + metaSuffix
+	fh, err := os.CreateTemp(filepath.Dir(fullPath), filepath.Base(fullPath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			fh.Close()
+			os.Remove(fh.Name())
+		}
+	}()
+	if _, err := fh.Write(data); err != nil {
+		return err
+	}
+	if s.Fsync {
+		if err := fh.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(fh.Name(), fullPath); err != nil {
+		return err
+	}
+	if s.Fsync {
+		return SyncDir(filepath.Dir(fullPath))
+	}
+	return nil
+}
+
+// ReadMeta returns the sidecar of the blob with the given hash, or an error
+// satisfying os.IsNotExist if it has none.
+func (s *Store) ReadMeta(hash []byte) ([]byte, error) {
+	return os.ReadFile(s.FullPath(hash) + metaSuffix)
+}
@@ -7,9 +7,11 @@ require (
 	github.com/Jille/errchain v1.0.0
 	github.com/google/go-cmp v0.5.6
 	github.com/icza/bitio v1.1.0
+	lukechampine.com/blake3 v1.1.7
 )
 
 require (
 	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/gorilla/schema v1.2.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.11 // indirect
 )
@@ -0,0 +1,251 @@
+package streisand
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+)
+
+// GossipConfig configures gossip based membership. Every node periodically
+// exchanges its member list with a random member or seed, so that nodes only
+// need to know a few seeds to find the entire cluster.
+type GossipConfig struct {
+	// Seeds are contacted to join the cluster.
+	Seeds []*url.URL
+	// Interval is the time between gossip rounds, and defaults to a second.
+	Interval time.Duration
+	// Timeout is how long a member may go unheard of before it's
+	// considered gone. It defaults to ten intervals.
+	Timeout time.Duration
+}
+
+// gossipTombstoneTimeouts is how many timeouts a forgotten member is
+// remembered for, so that heartbeats of it that are still going around don't
+// bring it back.
+const gossipTombstoneTimeouts = 100
+
+// gossip holds the membership as known to this node. Every member increases
+// its own heartbeat each round, and a member whose heartbeat doesn't increase
+// within the timeout is dropped. Heartbeats start at the time a node starts,
+// so that they keep increasing across restarts.
+type gossip struct {
+	self     *url.URL
+	interval time.Duration
+	timeout  time.Duration
+	seeds    []*url.URL
+
+	mutex     sync.Mutex
+	heartbeat uint64
+	members   map[string]*member
+	// forgotten holds the members that were dropped, with the time they
+	// were dropped as updated. Only newer heartbeats bring them back.
+	forgotten map[string]*member
+}
+
+type member struct {
+	url       *url.URL
+	heartbeat uint64
+	updated   time.Time
+}
+
+type gossipMessage struct {
+	// Members maps the URLs of members to their heartbeats.
+	Members map[string]uint64 `json:"members"`
+}
+
+func newGossip(conf GossipConfig, self *url.URL) (*gossip, error) {
+	if self == nil {
+		return nil, fmt.Errorf("gossip requires ServerConfig.Self")
+	}
+	g := &gossip{
+		self:     self,
+		interval: conf.Interval,
+		timeout:  conf.Timeout,
+		seeds:    conf.Seeds,
+
+		heartbeat: uint64(time.Now().UnixNano()),
+		members:   map[string]*member{},
+		forgotten: map[string]*member{},
+	}
+	if g.interval <= 0 {
+		g.interval = time.Second
+	}
+	if g.timeout <= 0 {
+		g.timeout = 10 * g.interval
+	}
+	return g, nil
+}
+
+// message returns our view of the membership, including ourselves.
+func (g *gossip) message() gossipMessage {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	msg := gossipMessage{Members: map[string]uint64{
+		g.self.String(): g.heartbeat,
+	}}
+	for u, m := range g.members {
+		if time.Since(m.updated) < g.timeout {
+			msg.Members[u] = m.heartbeat
+		}
+	}
+	return msg
+}
+
+// merge incorporates a member list received from another node.
+func (g *gossip) merge(msg gossipMessage) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for u, hb := range msg.Members {
+		if u == g.self.String() {
+			continue
+		}
+		if f, ok := g.forgotten[u]; ok {
+			if hb <= f.heartbeat {
+				continue
+			}
+			delete(g.forgotten, u)
+		}
+		m, ok := g.members[u]
+		if !ok {
+			parsed, err := url.Parse(u)
+			if err != nil {
+				continue
+			}
+			m = &member{url: parsed}
+			g.members[u] = m
+		} else if hb <= m.heartbeat {
+			continue
+		}
+		m.heartbeat = hb
+		m.updated = time.Now()
+	}
+}
+
+// tick starts a new round: it bumps our heartbeat, forgets long gone
+// members and returns a random node to gossip with.
+func (g *gossip) tick() *url.URL {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.heartbeat++
+	var targets []*url.URL
+	for u, m := range g.forgotten {
+		if time.Since(m.updated) > gossipTombstoneTimeouts*g.timeout {
+			delete(g.forgotten, u)
+		}
+	}
+	for u, m := range g.members {
+		if time.Since(m.updated) > 2*g.timeout {
+			delete(g.members, u)
+			m.updated = time.Now()
+			g.forgotten[u] = m
+		} else if time.Since(m.updated) < g.timeout {
+			targets = append(targets, m.url)
+		}
+	}
+	for _, s := range g.seeds {
+		if s.String() != g.self.String() {
+			targets = append(targets, s)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	return targets[rand.Intn(len(targets))]
+}
+
+// peers returns the live members, including ourselves. It's used as
+// ServerConfig.GetPeers.
+func (g *gossip) peers() ([]*url.URL, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	ret := []*url.URL{g.self}
+	for _, m := range g.members {
+		if time.Since(m.updated) < g.timeout {
+			ret = append(ret, m.url)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].String() < ret[j].String()
+	})
+	return ret, nil
+}
+
+func (s *server) gossipLoop() {
+	defer s.background.Done()
+	t := time.NewTicker(s.gossip.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+		}
+		target := s.gossip.tick()
+		if target == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.gossip.interval)
+		if err := s.gossipWith(ctx, target); err != nil {
+			s.log.Debug("gossip failed", "peer", target.String(), "err", err)
+		}
+		cancel()
+	}
+}
+
+// gossipWith exchanges member lists with target.
+func (s *server) gossipWith(ctx context.Context, target *url.URL) error {
+	b, err := json.Marshal(s.gossip.message())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.peerContext(ctx)
+	defer cancel()
+	req, err := s.newPeerRequest(ctx, "POST", peerURL(target, "/internal/gossip"), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("HTTP error: %s", resp.Status)
+	}
+	var msg gossipMessage
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return err
+	}
+	s.gossip.merge(msg)
+	return nil
+}
+
+func (s *server) handleGossip(r *http.Request) convreq.HttpResponse {
+	if r.Method != "POST" {
+		return respond.MethodNotAllowed("Method Not Allowed")
+	}
+	if s.gossip == nil {
+		return respond.NotFound("gossip is not enabled")
+	}
+	var msg gossipMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		return respond.BadRequest(err.Error())
+	}
+	s.gossip.merge(msg)
+	b, err := json.Marshal(s.gossip.message())
+	if err != nil {
+		return respond.Error(err)
+	}
+	return respond.WithHeader(respond.Bytes(b), "Content-Type", "application/json")
+}
@@ -0,0 +1,219 @@
+package streisand
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"path/filepath"
+	"sort"
+
+	"github.com/bertha/streisand/diskstore"
+	"lukechampine.com/blake3"
+)
+
+// HashAlgorithm is a hash function that blobs can be addressed by.
+//
+// Blobs hashed with SHA256 are addressed by their plain digest. Blobs hashed
+// with any other algorithm are addressed by their multihash: the varint
+// multicodec Code, the varint digest Size and the digest. The hex encoding
+// of that address is what /upload returns and what /blob/ takes.
+type HashAlgorithm struct {
+	// Name is used in the X-StreiSANd-Hash-Algorithm header and as the
+	// directory name of the algorithm's stores.
+	Name string
+	Code uint64
+	Size int
+	New  func() hash.Hash
+}
+
+var (
+	SHA256 = &HashAlgorithm{Name: "sha2-256", Code: 0x12, Size: 32, New: sha256.New}
+	SHA512 = &HashAlgorithm{Name: "sha2-512", Code: 0x13, Size: 64, New: sha512.New}
+	BLAKE3 = &HashAlgorithm{Name: "blake3", Code: 0x1e, Size: 32, New: func() hash.Hash {
+		return blake3.New(32, nil)
+	}}
+)
+
+// LookupHashAlgorithm returns the hash algorithm with the given Name.
+func LookupHashAlgorithm(name string) (*HashAlgorithm, bool) {
+	for _, a := range []*HashAlgorithm{SHA256, SHA512, BLAKE3} {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+var errUnknownAlgorithm = errors.New("unknown or disabled hash algorithm")
+
+// key returns the address of a blob with the given digest.
+func (a *HashAlgorithm) key(digest []byte) []byte {
+	if a == SHA256 {
+		return digest
+	}
+	key := make([]byte, 0, 2*binary.MaxVarintLen64+len(digest))
+	key = appendUvarint(key, a.Code)
+	key = appendUvarint(key, uint64(len(digest)))
+	return append(key, digest...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// splitKey splits a blob address into the code of its hash algorithm and
+// its digest.
+func splitKey(key []byte) (uint64, []byte, error) {
+	if len(key) == SHA256.Size {
+		return SHA256.Code, key, nil
+	}
+	code, n := binary.Uvarint(key)
+	if n <= 0 {
+		return 0, nil, errors.New("invalid multihash")
+	}
+	size, m := binary.Uvarint(key[n:])
+	if m <= 0 || uint64(len(key)-n-m) != size {
+		return 0, nil, errors.New("invalid multihash")
+	}
+	return code, key[n+m:], nil
+}
+
+// normalizeKey turns a SHA-256 multihash into a plain SHA-256 digest, so
+// that every blob has one address.
+func normalizeKey(key []byte) []byte {
+	code, digest, err := splitKey(key)
+	if err == nil && code == SHA256.Code && len(digest) == SHA256.Size {
+		return digest
+	}
+	return key
+}
+
+// xorHash returns the hash that represents digest in the xor tree, which is
+// its first BytesPerHash bytes. It's also used for placement.
+func xorHash(digest []byte) *Hash {
+	var h Hash
+	copy(h[:], digest)
+	return &h
+}
+
+// keyHash returns the xorHash of the digest in key, or of key itself if it
+// can't be parsed.
+func keyHash(key []byte) *Hash {
+	if _, digest, err := splitKey(key); err == nil {
+		return xorHash(digest)
+	}
+	return xorHash(key)
+}
+
+// hashStore holds the blobs hashed with one algorithm.
+type hashStore struct {
+	algo  *HashAlgorithm
+	store *diskstore.Store
+	xors  *XorStore
+}
+
+// newHashStore creates the stores for algo. The SHA-256 stores live in the
+// root of DataDir and CacheDir, the others in a subdirectory named after
+// the algorithm.
+func (s *server) newHashStore(algo *HashAlgorithm) *hashStore {
+	dataDir, cacheDir := s.conf.DataDir, s.conf.CacheDir
+	if algo != SHA256 {
+		dataDir = filepath.Join(dataDir, algo.Name)
+		cacheDir = filepath.Join(cacheDir, algo.Name)
+	}
+	return &hashStore{
+		algo: algo,
+		store: &diskstore.Store{
+			Path:          dataDir,
+			BitsPerFolder: s.conf.BitsPerFolder,
+			Fsync:         s.conf.WithFsync,
+			Hash:          algo.New,
+		},
+		xors: &XorStore{
+			LayerCount: s.conf.LayerCount,
+			LayerDepth: s.conf.LayerDepth,
+			Path:       cacheDir,
+			Logger:     s.conf.Logger,
+			Fsync:      s.conf.WithFsync,
+			Sparse:     s.conf.SparseXors,
+		},
+	}
+}
+
+// computeLeaf returns the xor of the hashes of all blobs in the store that
+// are in the xor leaf of h.
+func (hs *hashStore) computeLeaf(ctx context.Context, h *Hash) (Hash, error) {
+	var sum Hash
+	err := hs.store.Scan(ctx, h[:], uint8(hs.xors.Depth()), func(digest []byte) {
+		xorHash(digest).XorInto(sum[:])
+	})
+	return sum, err
+}
+
+// leaf returns computeLeaf with ctx, as XorStore.Recover and RepairLeaves take
+// it.
+func (hs *hashStore) leaf(ctx context.Context) func(h *Hash) (Hash, error) {
+	return func(h *Hash) (Hash, error) {
+		return hs.computeLeaf(ctx, h)
+	}
+}
+
+// lookup returns the store that holds the blob with the given address, and
+// the blob's digest.
+func (s *server) lookup(key []byte) (*hashStore, []byte, error) {
+	code, digest, err := splitKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	hs, ok := s.hashStores[code]
+	if !ok || len(digest) != hs.algo.Size {
+		return nil, nil, errUnknownAlgorithm
+	}
+	return hs, digest, nil
+}
+
+// blobPath returns the path of the blob with the given address.
+func (s *server) blobPath(key []byte) (string, error) {
+	hs, digest, err := s.lookup(key)
+	if err != nil {
+		return "", err
+	}
+	return hs.store.FullPath(digest), nil
+}
+
+// sortedHashStores returns the stores of all enabled algorithms, ordered by
+// multihash code.
+func (s *server) sortedHashStores() []*hashStore {
+	ret := make([]*hashStore, 0, len(s.hashStores))
+	for _, hs := range s.hashStores {
+		ret = append(ret, hs)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].algo.Code < ret[j].algo.Code
+	})
+	return ret
+}
+
+// hashStoreFor returns the store for the hash algorithm the client asked for
+// in the X-StreiSANd-Hash-Algorithm header or hash query parameter.
+func (s *server) hashStoreFor(r *http.Request) (*hashStore, error) {
+	name := r.Header.Get("X-StreiSANd-Hash-Algorithm")
+	if name == "" {
+		name = r.URL.Query().Get("hash")
+	}
+	if name == "" {
+		return s.hashStores[SHA256.Code], nil
+	}
+	for _, hs := range s.hashStores {
+		if hs.algo.Name == name {
+			return hs, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", errUnknownAlgorithm, name)
+}
@@ -0,0 +1,95 @@
+package streisand
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+func TestHashAlgorithms(t *testing.T) {
+	newServer := func(peers ...*url.URL) Server {
+		s, err := NewServer(ServerConfig{
+			DataDir:        t.TempDir(),
+			CacheDir:       t.TempDir(),
+			HashAlgorithms: []*HashAlgorithm{BLAKE3, SHA512},
+			GetPeers: func() ([]*url.URL, error) {
+				return peers, nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			s.Close()
+		})
+		return s
+	}
+	peer := newServer()
+	hs := httptest.NewServer(peer)
+	defer hs.Close()
+	s := newServer(mustParseURLs(t, hs.URL)...)
+
+	b3 := blake3.Sum256([]byte("data"))
+	s512 := sha512.Sum512([]byte("data"))
+	s256 := sha256.Sum256([]byte("data"))
+	for _, tc := range []struct {
+		algo string
+		want string
+	}{
+		{"", hex.EncodeToString(s256[:])},
+		{"sha2-256", hex.EncodeToString(s256[:])},
+		{"blake3", "1e20" + hex.EncodeToString(b3[:])},
+		{"sha2-512", "1340" + hex.EncodeToString(s512[:])},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/upload?hash="+tc.algo, strings.NewReader("data")))
+		if w.Code != 200 || w.Body.String() != tc.want {
+			t.Errorf("upload with %q returned %d %q, want %q", tc.algo, w.Code, w.Body, tc.want)
+			continue
+		}
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+tc.want, nil))
+		if w.Code != 200 || w.Body.String() != "data" {
+			t.Errorf("GET %s returned %d %q", tc.want, w.Code, w.Body)
+		}
+	}
+
+	// The SHA-256 multihash is another name for the plain digest.
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/blob/1220"+hex.EncodeToString(s256[:]), nil))
+	if w.Code != 200 || w.Body.String() != "data" {
+		t.Errorf("GET by SHA-256 multihash returned %d %q", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/upload?hash=md5", strings.NewReader("data")))
+	if w.Code != 400 {
+		t.Errorf("upload with unknown algorithm returned %d", w.Code)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for s.(*server).outbox.pending(hs.URL) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("blobs weren't replicated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w = httptest.NewRecorder()
+	peer.ServeHTTP(w, httptest.NewRequest("GET", "/blob/1e20"+hex.EncodeToString(b3[:]), nil))
+	if w.Code != 200 || w.Body.String() != "data" {
+		t.Errorf("GET of replicated BLAKE3 blob returned %d %q", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	newTestServer(t).ServeHTTP(w, httptest.NewRequest("GET", "/blob/1e20"+hex.EncodeToString(b3[:]), nil))
+	if w.Code != 400 {
+		t.Errorf("GET of BLAKE3 blob on server without BLAKE3 returned %d", w.Code)
+	}
+}
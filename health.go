@@ -0,0 +1,158 @@
+package streisand
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+)
+
+// peerTracker keeps track of how replication to and from each peer is going.
+type peerTracker struct {
+	mutex sync.Mutex
+	peers map[string]*peerState
+}
+
+type peerState struct {
+	lastSuccess time.Time
+	lastError   error
+	errorSince  time.Time
+}
+
+func (t *peerTracker) get(peer string) *peerState {
+	if t.peers == nil {
+		t.peers = map[string]*peerState{}
+	}
+	ps, ok := t.peers[peer]
+	if !ok {
+		ps = &peerState{}
+		t.peers[peer] = ps
+	}
+	return ps
+}
+
+// observe records the outcome of a transfer to or from peer.
+func (t *peerTracker) observe(peer string, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ps := t.get(peer)
+	if err != nil {
+		if ps.lastError == nil {
+			ps.errorSince = time.Now()
+		}
+		ps.lastError = err
+		return
+	}
+	ps.lastSuccess = time.Now()
+	ps.lastError = nil
+}
+
+type peerStatus struct {
+	URL             string     `json:"url"`
+	LastSuccess     *time.Time `json:"last_success,omitempty"`
+	MissingEstimate int        `json:"missing_estimate"`
+	Error           string     `json:"error,omitempty"`
+	ErrorSince      *time.Time `json:"error_since,omitempty"`
+}
+
+func (t *peerTracker) status(peer string) peerStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ps := t.get(peer)
+	ret := peerStatus{
+		URL: peer,
+	}
+	if !ps.lastSuccess.IsZero() {
+		ls := ps.lastSuccess
+		ret.LastSuccess = &ls
+	}
+	if ps.lastError != nil {
+		es := ps.errorSince
+		ret.Error = ps.lastError.Error()
+		ret.ErrorSince = &es
+	}
+	return ret
+}
+
+func (s *server) handleHealthz(r *http.Request) convreq.HttpResponse {
+	return respond.String("ok\n")
+}
+
+// checkReady returns an error describing why this server shouldn't receive
+// traffic, or nil if it should.
+func (s *server) checkReady() error {
+	s.rlock()
+	initialized := s.xors.Initialized()
+	s.mutex.RUnlock()
+	if !initialized {
+		return fmt.Errorf("xor store is not initialized")
+	}
+	if err := s.store.CheckWritable(); err != nil {
+		return fmt.Errorf("data dir is not writable: %w", err)
+	}
+	if s.conf.MinFreeBytes > 0 {
+		free, err := s.store.FreeSpace()
+		if err != nil {
+			return fmt.Errorf("checking free space: %w", err)
+		}
+		if free < s.conf.MinFreeBytes {
+			return fmt.Errorf("only %d bytes free in data dir, want at least %d", free, s.conf.MinFreeBytes)
+		}
+	}
+	return nil
+}
+
+func (s *server) handleReadyz(r *http.Request) convreq.HttpResponse {
+	if err := s.checkReady(); err != nil {
+		return respond.ServiceUnavailable(err.Error())
+	}
+	return respond.String("ok\n")
+}
+
+type serverStatus struct {
+	Ready      bool         `json:"ready"`
+	NotReady   string       `json:"not_ready,omitempty"`
+	Blobs      int64        `json:"blobs"`
+	StoreBytes int64        `json:"store_bytes"`
+	Peers      []peerStatus `json:"peers"`
+	PeersError string       `json:"peers_error,omitempty"`
+}
+
+func (s *server) handleStatus(r *http.Request) convreq.HttpResponse {
+	if r.Method != "GET" {
+		return respond.MethodNotAllowed("Method Not Allowed")
+	}
+	st := serverStatus{
+		Ready:      true,
+		Blobs:      atomic.LoadInt64(&s.metrics.blobs),
+		StoreBytes: atomic.LoadInt64(&s.metrics.storeBytes),
+		Peers:      []peerStatus{},
+	}
+	if err := s.checkReady(); err != nil {
+		st.Ready = false
+		st.NotReady = err.Error()
+	}
+	if s.conf.GetPeers != nil {
+		peers, err := s.conf.GetPeers()
+		if err != nil {
+			st.PeersError = err.Error()
+		}
+		for _, p := range peers {
+			ps := s.peers.status(p.String())
+			// The blobs still in the outbox are the ones we know
+			// the peer is missing.
+			ps.MissingEstimate = s.outbox.pending(p.String())
+			st.Peers = append(st.Peers, ps)
+		}
+	}
+	b, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		return respond.Error(err)
+	}
+	return respond.WithHeader(respond.Bytes(b), "Content-Type", "application/json")
+}
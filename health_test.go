@@ -0,0 +1,59 @@
+package streisand
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	s, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/healthz", "/readyz", "/status"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 200 {
+			t.Errorf("GET %s: %d: %s", path, w.Code, w.Body)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != 503 {
+		t.Errorf("GET /readyz after Close: %d, want 503", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	var st serverStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Ready {
+		t.Error("/status reports ready after Close")
+	}
+}
+
+func TestPeerTracker(t *testing.T) {
+	var pt peerTracker
+	pt.observe("peer:1", errors.New("connection refused"))
+	st := pt.status("peer:1")
+	if st.Error == "" || st.ErrorSince == nil || st.LastSuccess != nil {
+		t.Errorf("after failed push: %+v", st)
+	}
+	pt.observe("peer:1", nil)
+	st = pt.status("peer:1")
+	if st.Error != "" || st.LastSuccess == nil {
+		t.Errorf("after successful push: %+v", st)
+	}
+}
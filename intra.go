@@ -2,28 +2,66 @@ package streisand
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"net/url"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
-func init() {
-	// We know that the only server we send Expect:100-continue to is ourselves, so there's no need for this fallback for servers which don't support it properly.
-	// This prevents us from unintentionally sending an internal put to an overloaded server which didn't respond in 1s.
-	http.DefaultTransport.(*http.Transport).ExpectContinueTimeout = 30 * time.Second
-}
+var (
+	// errBlobGone is returned by pushBlob if we don't have the blob
+	// anymore, for example because it was quarantined.
+	errBlobGone = errors.New("blob isn't stored here anymore")
+	// errPushRejected is returned by pushBlob if the peer refused that
+	// blob, rather than failing.
+	errPushRejected = errors.New("peer rejected the blob")
+)
 
-// pushBlob sends a blob to a target server (given as host:port)
+// pushBlob sends a blob to a target server (given by its base URL)
+// If namespace isn't empty, the target adds the blob to that namespace.
 // Passing in an fh is optional, but if you do, it will be closed before returning.
-func (s *server) pushBlob(target string, hash []byte, fh *os.File) error {
-	// TODO: locking
+func (s *server) pushBlob(ctx context.Context, target *url.URL, hash []byte, namespace string, fh *os.File) (err error) {
+	peer := target.String()
+	ctx = withLogFields(ctx, "peer", peer, "hash", hex.EncodeToString(hash))
+	defer func(ctx context.Context, start time.Time) {
+		// A push that the caller canceled, like the ones awaitReplicas
+		// no longer needs, says nothing about the peer.
+		if err != nil && ctx.Err() == context.Canceled {
+			return
+		}
+		// Neither does a blob that we can't send.
+		if errors.Is(err, errBlobGone) {
+			return
+		}
+		s.metrics.observePush(peer, start, err)
+		s.peers.observe(peer, err)
+		s.logTransfer(ctx, "push", start, err)
+	}(ctx, time.Now())
+	done, err := s.limiter.startTransfer(ctx, peer)
+	if err != nil {
+		return err
+	}
+	defer done()
+	ctx, cancel := s.peerContext(ctx)
+	defer cancel()
+	// Opening the blob needs no lock. Blobs are renamed into place once
+	// complete, and a blob that's deleted or quarantined after we opened it
+	// stays readable through fh until it's closed.
 	if fh == nil {
-		var err error
-		fh, err = s.store.Get(hash)
+		hs, digest, err := s.lookup(hash)
+		if err != nil {
+			return err
+		}
+		fh, err = hs.store.Get(digest)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %v", errBlobGone, err)
+		}
 		if err != nil {
 			return err
 		}
@@ -33,39 +71,96 @@ func (s *server) pushBlob(target string, hash []byte, fh *os.File) error {
 	if err != nil {
 		return err
 	}
-	u := url.URL{
-		Scheme: "http",
-		Host:   target,
-		Path:   "/internal/upload",
+	var body io.Reader = s.limiter.replicationReader(ctx, peer, countingReader{fh, &s.metrics.bytesOut})
+	if s.conf.PeerCredentials != nil {
+		// Signers can't hash the streamed body themselves.
+		bodyDigest, err := s.contentSHA256(hash, fh)
+		if err != nil {
+			return err
+		}
+		body = digestedBody{body, bodyDigest}
 	}
-	req, err := http.NewRequest("POST", u.String(), fh)
+	req, err := s.newPeerRequest(ctx, "POST", peerURL(target, "/internal/upload"), body)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Expect", "100-continue")
 	req.Header.Set("X-StreiSANd-Hash", hex.EncodeToString(hash))
+	if namespace != "" {
+		req.Header.Set("X-StreiSANd-Namespace", namespace)
+	}
+	if md, err := s.readMetadata(s.namespaces[namespace], hash); err != nil {
+		return err
+	} else if md != nil {
+		v, err := md.encode()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-StreiSANd-Metadata", v)
+	}
 	req.Header.Set("Content-Length", fmt.Sprint(st.Size()))
-	resp, err := http.DefaultClient.Do(req)
+	req.ContentLength = st.Size()
+	resp, err := s.client.Do(req)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("HTTP error: %s", resp.Status)
+	defer resp.Body.Close()
+	// 409 Conflict means the target already has the blob.
+	switch {
+	case resp.StatusCode == 200 || resp.StatusCode == 409:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != 408 && resp.StatusCode != 429:
+		return fmt.Errorf("%w: %s", errPushRejected, resp.Status)
+	}
+	return fmt.Errorf("HTTP error: %s", resp.Status)
+}
+
+// contentSHA256 returns the hex SHA-256 of the contents of blob key, which
+// are in fh. That's the blob's digest unless another hash algorithm addresses
+// it, in which case fh is read and rewound.
+func (s *server) contentSHA256(key []byte, fh *os.File) (string, error) {
+	hs, digest, err := s.lookup(key)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	if hs.algo == SHA256 {
+		return hex.EncodeToString(digest), nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", err
+	}
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func (s *server) pullBlob(target string, hash []byte) error {
-	u := url.URL{
-		Scheme: "http",
-		Host:   target,
-		Path:   "/internal/blob/" + hex.EncodeToString(hash),
+func (s *server) pullBlob(ctx context.Context, target *url.URL, hash []byte) (err error) {
+	peer := target.String()
+	ctx = withLogFields(ctx, "peer", peer, "hash", hex.EncodeToString(hash))
+	defer func(start time.Time) {
+		s.metrics.observePull(peer, start, err)
+		s.peers.observe(peer, err)
+		s.logTransfer(ctx, "pull", start, err)
+	}(time.Now())
+	hs, digest, err := s.lookup(hash)
+	if err != nil {
+		return err
+	}
+	done, err := s.limiter.startTransfer(ctx, peer)
+	if err != nil {
+		return err
 	}
-	req, err := http.NewRequest("GET", u.String(), nil)
+	defer done()
+	ctx, cancel := s.peerContext(ctx)
+	defer cancel()
+	req, err := s.newPeerRequest(ctx, "GET",
+		peerURL(target, "/internal/blob/"+hex.EncodeToString(hash)), nil)
 	if err != nil {
 		return err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -73,29 +168,55 @@ func (s *server) pullBlob(target string, hash []byte) error {
 	if resp.StatusCode != 200 {
 		return fmt.Errorf("HTTP error: %s", resp.Status)
 	}
-	w, err := s.store.NewWriter()
+	w, err := hs.store.NewWriter()
 	if err != nil {
 		return err
 	}
 	defer w.Abort()
-	if _, err := io.Copy(w, resp.Body); err != nil {
+	n, err := io.Copy(w, s.limiter.replicationReader(ctx, peer, resp.Body))
+	if err != nil {
 		return err
 	}
+	atomic.AddUint64(&s.metrics.bytesIn, uint64(n))
 	if err := resp.Body.Close(); err != nil {
 		return err
 	}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	// Check the hash before storing the blob, so a corrupt copy from a
+	// peer never ends up in the store.
+	if !bytes.Equal(digest, w.Sum()) {
+		return fmt.Errorf("remote returned incorrect file: want %q, got %q", hex.EncodeToString(hash), hex.EncodeToString(hs.algo.key(w.Sum())))
+	}
+
+	defer s.lockBlob(hs, digest)()
+
+	prepared, err := hs.xors.Prepare(xorHash(digest))
+	if err != nil {
+		return err
+	}
+	defer prepared()
 
-	if err := w.Close(); err != nil {
+	if err = w.Close(); err != nil {
 		return err
 	}
-	if bytes.Compare(hash, w.Hash()) != 0 {
-		return fmt.Errorf("remote returned incorrect file: want %q, got %q", hex.EncodeToString(hash), hex.EncodeToString(w.Hash()))
+	md, err := decodeMetadata(resp.Header.Get("X-StreiSANd-Metadata"))
+	if err != nil {
+		return fmt.Errorf("invalid metadata from remote: %w", err)
+	}
+	if err := s.writeMetadata(nil, hash, md); err != nil {
+		return err
 	}
 	if w.IsNew() {
-		s.xors.Add((*Hash)(hash))
+		hs.xors.Add(xorHash(digest))
+		s.metrics.addBlob(n)
 	}
 	return nil
 }
+
+func (s *server) logTransfer(ctx context.Context, op string, start time.Time, err error) {
+	if err != nil {
+		s.logger(ctx).Warn(op+" failed", "duration", time.Since(start), "err", err)
+		return
+	}
+	s.logger(ctx).Debug(op+" succeeded", "duration", time.Since(start))
+}
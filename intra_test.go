@@ -0,0 +1,53 @@
+package streisand
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPeerTimeout(t *testing.T) {
+	// The peer doesn't answer until the test is over.
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer stuck.Close()
+	defer close(release)
+	peer := mustParseURLs(t, stuck.URL)[0]
+
+	srv, err := NewServer(ServerConfig{
+		DataDir:     t.TempDir(),
+		CacheDir:    t.TempDir(),
+		PeerTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	s := srv.(*server)
+	hash := upload(t, s, "data")
+	key, _ := httpPathToKey("/blob/" + hash)
+
+	start := time.Now()
+	if err := s.pushBlob(context.Background(), peer, key, "", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("pushBlob returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := s.pullBlob(context.Background(), peer, key); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("pullBlob returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("requests to a stuck peer took %s", d)
+	}
+
+	// Canceling the caller's context stops a request too.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	s.conf.PeerTimeout = 0
+	if err := s.pullBlob(ctx, peer, key); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled pullBlob returned %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,219 @@
+package streisand
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// ReplicationLimits limit the resources used by replication between peers.
+// Zero values mean unlimited.
+type ReplicationLimits struct {
+	// BytesPerSecond and Transfers limit the bandwidth and the number of
+	// concurrent transfers of all replication together.
+	BytesPerSecond int64
+	Transfers      int
+	// PeerBytesPerSecond and PeerTransfers limit them per peer.
+	PeerBytesPerSecond int64
+	PeerTransfers      int
+}
+
+// rateLimiter is a token bucket that holds at most a second worth of bytes.
+// Replication waits for tokens, while client traffic takes them without
+// waiting, so that replication only gets the bandwidth clients leave over.
+// The debt clients can leave is capped at about a second worth of bytes as
+// well, so that a burst of client traffic doesn't stall replication for long.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// take removes n tokens, possibly leaving the bucket in debt, and returns
+// how long to wait until the debt is paid off.
+func (l *rateLimiter) take(n int) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	} else if l.tokens < -l.rate {
+		l.tokens = -l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait takes n tokens and blocks until they're available.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	d := l.take(n)
+	if d == 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// semaphore limits concurrency. A nil semaphore allows everything.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// limiter enforces the ReplicationLimits.
+type limiter struct {
+	conf      ReplicationLimits
+	rate      *rateLimiter
+	transfers semaphore
+
+	mutex sync.Mutex
+	peers map[string]*peerLimiter
+}
+
+type peerLimiter struct {
+	rate      *rateLimiter
+	transfers semaphore
+}
+
+func newLimiter(conf ReplicationLimits) *limiter {
+	return &limiter{
+		conf:      conf,
+		rate:      newRateLimiter(conf.BytesPerSecond),
+		transfers: newSemaphore(conf.Transfers),
+		peers:     map[string]*peerLimiter{},
+	}
+}
+
+func (l *limiter) peer(peer string) *peerLimiter {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	pl, ok := l.peers[peer]
+	if !ok {
+		pl = &peerLimiter{
+			rate:      newRateLimiter(l.conf.PeerBytesPerSecond),
+			transfers: newSemaphore(l.conf.PeerTransfers),
+		}
+		l.peers[peer] = pl
+	}
+	return pl
+}
+
+// startTransfer blocks until a transfer with peer may start, and returns a
+// function that must be called when it's done.
+func (l *limiter) startTransfer(ctx context.Context, peer string) (func(), error) {
+	pl := l.peer(peer)
+	if err := pl.transfers.acquire(ctx); err != nil {
+		return nil, err
+	}
+	if err := l.transfers.acquire(ctx); err != nil {
+		pl.transfers.release()
+		return nil, err
+	}
+	return func() {
+		l.transfers.release()
+		pl.transfers.release()
+	}, nil
+}
+
+// replicationReader throttles r to the bandwidth limits for peer.
+func (l *limiter) replicationReader(ctx context.Context, peer string, r io.ReadCloser) io.ReadCloser {
+	var rates []*rateLimiter
+	if pl := l.peer(peer); pl.rate != nil {
+		rates = append(rates, pl.rate)
+	}
+	if l.rate != nil {
+		rates = append(rates, l.rate)
+	}
+	if len(rates) == 0 {
+		return r
+	}
+	return throttledReader{r, ctx, rates}
+}
+
+// clientReader accounts the traffic through r against the global bandwidth
+// limit without ever waiting, so that replication yields to clients.
+func (l *limiter) clientReader(r io.ReadCloser) io.ReadCloser {
+	if l.rate == nil {
+		return r
+	}
+	return clientReader{r, l.rate}
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	ctx   context.Context
+	rates []*rateLimiter
+}
+
+func (t throttledReader) Read(p []byte) (int, error) {
+	// Don't read more than the bucket can hold at once.
+	for _, r := range t.rates {
+		if max := int(r.rate); len(p) > max {
+			p = p[:max]
+		}
+	}
+	n, err := t.ReadCloser.Read(p)
+	for _, r := range t.rates {
+		if werr := r.wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type clientReader struct {
+	io.ReadCloser
+	rate *rateLimiter
+}
+
+func (c clientReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.rate.take(n)
+	return n, err
+}
@@ -0,0 +1,54 @@
+package streisand
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1000)
+	if d := l.take(1000); d != 0 {
+		t.Errorf("taking a full bucket made us wait %v", d)
+	}
+	// Client traffic put the bucket in debt, so replication has to wait
+	// for about half a second.
+	if d := l.take(500); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("taking from an empty bucket made us wait %v, want ~500ms", d)
+	}
+	// However much clients take, the debt is capped at about a second.
+	l.take(1e6)
+	if d := l.take(500); d < 1400*time.Millisecond || d > 1500*time.Millisecond {
+		t.Errorf("taking after a burst of client traffic made us wait %v, want ~1.5s", d)
+	}
+	if newRateLimiter(0) != nil {
+		t.Error("newRateLimiter(0) should be unlimited")
+	}
+}
+
+func TestTransferLimits(t *testing.T) {
+	l := newLimiter(ReplicationLimits{Transfers: 2, PeerTransfers: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	doneA, err := l.startTransfer(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.startTransfer(ctx, "a"); err == nil {
+		t.Error("second transfer to a started despite PeerTransfers: 1")
+	}
+	doneA()
+
+	if _, err := l.startTransfer(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.startTransfer(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.startTransfer(ctx, "c"); err == nil {
+		t.Error("third transfer started despite Transfers: 2")
+	}
+}
@@ -0,0 +1,40 @@
+package streisand
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// blobLockStripes is the number of locks that blobs are spread over.
+//
+// Operations on a single blob, like committing it to the store and adding it
+// to the xor tree, hold s.mutex for reading and the lock of the blob's xor
+// leaf. All blobs in a leaf share a lock, so checkXorsumOf can compare a leaf
+// with the store without uploads interfering, while uploads to other leaves
+// proceed in parallel. The upper layers of the xor tree are shared between
+// leaves, so Layer.Add updates them atomically. Only Close holds s.mutex for
+// writing. Namespace locks are acquired after blob locks.
+const blobLockStripes = 256
+
+// lockBlob acquires the lock of the blob with the given digest in hs, records
+// how long that took, and returns a function that releases it.
+func (s *server) lockBlob(hs *hashStore, digest []byte) (unlock func()) {
+	m := &s.blobLocks[xorHash(digest).PrefixToNumber(uint(hs.xors.Depth()))%blobLockStripes]
+	start := time.Now()
+	s.mutex.RLock()
+	m.Lock()
+	atomic.AddUint64(&s.metrics.writeLockWait, uint64(time.Since(start)))
+	atomic.AddUint64(&s.metrics.writeLocks, 1)
+	return func() {
+		m.Unlock()
+		s.mutex.RUnlock()
+	}
+}
+
+// rlock acquires s.mutex for reading and records how long that took.
+func (s *server) rlock() {
+	start := time.Now()
+	s.mutex.RLock()
+	atomic.AddUint64(&s.metrics.readLockWait, uint64(time.Since(start)))
+	atomic.AddUint64(&s.metrics.readLocks, 1)
+}
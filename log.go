@@ -0,0 +1,189 @@
+package streisand
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Logger is a leveled, structured logger. The variadic arguments are
+// alternating keys and values, so a *slog.Logger satisfies this interface.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// NewStdLogger returns a Logger that writes logfmt-like lines through the
+// standard log package. Debug messages are dropped unless debug is set.
+func NewStdLogger(l *log.Logger, debug bool) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return stdLogger{l, debug}
+}
+
+type stdLogger struct {
+	l     *log.Logger
+	debug bool
+}
+
+func (l stdLogger) log(level, msg string, kv []interface{}) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "level=%s msg=%q", level, msg)
+	for i := 0; i < len(kv); i += 2 {
+		var v interface{} = "(MISSING)"
+		if i+1 < len(kv) {
+			v = kv[i+1]
+		}
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		s := fmt.Sprint(v)
+		if strings.ContainsAny(s, " \"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		fmt.Fprintf(&sb, " %v=%s", kv[i], s)
+	}
+	l.l.Print(sb.String())
+}
+
+func (l stdLogger) Debug(msg string, kv ...interface{}) {
+	if l.debug {
+		l.log("DEBUG", msg, kv)
+	}
+}
+
+func (l stdLogger) Info(msg string, kv ...interface{}) {
+	l.log("INFO", msg, kv)
+}
+
+func (l stdLogger) Warn(msg string, kv ...interface{}) {
+	l.log("WARN", msg, kv)
+}
+
+func (l stdLogger) Error(msg string, kv ...interface{}) {
+	l.log("ERROR", msg, kv)
+}
+
+// fieldLogger prepends a fixed set of key-value pairs to every message.
+type fieldLogger struct {
+	l      Logger
+	fields []interface{}
+}
+
+func (l fieldLogger) with(kv []interface{}) []interface{} {
+	return append(l.fields[:len(l.fields):len(l.fields)], kv...)
+}
+
+func (l fieldLogger) Debug(msg string, kv ...interface{}) { l.l.Debug(msg, l.with(kv)...) }
+func (l fieldLogger) Info(msg string, kv ...interface{})  { l.l.Info(msg, l.with(kv)...) }
+func (l fieldLogger) Warn(msg string, kv ...interface{})  { l.l.Warn(msg, l.with(kv)...) }
+func (l fieldLogger) Error(msg string, kv ...interface{}) { l.l.Error(msg, l.with(kv)...) }
+
+type logFieldsKey struct{}
+type requestIDKey struct{}
+
+// withLogFields returns a context whose logger (see server.logger) includes
+// the given key-value pairs in every message.
+func withLogFields(ctx context.Context, kv ...interface{}) context.Context {
+	fields, _ := ctx.Value(logFieldsKey{}).([]interface{})
+	fields = append(fields[:len(fields):len(fields)], kv...)
+	return context.WithValue(ctx, logFieldsKey{}, fields)
+}
+
+// logger returns s.log with the fields attached to ctx by withLogFields.
+func (s *server) logger(ctx context.Context) Logger {
+	fields, _ := ctx.Value(logFieldsKey{}).([]interface{})
+	if len(fields) == 0 {
+		return s.log
+	}
+	return fieldLogger{s.log, fields}
+}
+
+// withRequestID attaches a request ID to ctx, both for logging and for
+// propagating it to peers through the X-Request-ID header.
+func withRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	return withLogFields(ctx, "request_id", id)
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// detach returns a context for work that outlives the request of ctx, which
+// isn't canceled with it but keeps its request ID.
+func detach(ctx context.Context) context.Context {
+	detached := context.Background()
+	if id := requestID(ctx); id != "" {
+		detached = withRequestID(detached, id)
+	}
+	return detached
+}
+
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// setRequestID copies the request ID from ctx into an outgoing request.
+func setRequestID(ctx context.Context, req *http.Request) {
+	if id := requestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logRequests assigns every request a request ID, reusing the one sent by
+// the client or peer if there is one, and logs the request when it's done.
+func (s *server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(withRequestID(r.Context(), id))
+
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+		s.logger(r.Context()).Debug("handled request",
+			"method", r.Method, "path", r.URL.Path,
+			"remote", r.RemoteAddr, "status", sr.status,
+			"duration", time.Since(start))
+	})
+}
@@ -0,0 +1,39 @@
+package streisand
+
+import (
+	"bytes"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	s, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		Logger:   NewStdLogger(log.New(&buf, "", 0), true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	req := httptest.NewRequest("GET", "/list", nil)
+	req.Header.Set("X-Request-ID", "c0ffee")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if got := w.Header().Get("X-Request-ID"); got != "c0ffee" {
+		t.Errorf("X-Request-ID = %q, want %q", got, "c0ffee")
+	}
+	if want := `level=DEBUG msg="handled request" request_id=c0ffee method=GET path=/list`; !strings.Contains(buf.String(), want) {
+		t.Errorf("log doesn't contain %q:\n%s", want, buf.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/list", nil))
+	if w.Header().Get("X-Request-ID") == "" {
+		t.Error("no X-Request-ID was generated")
+	}
+}
@@ -0,0 +1,146 @@
+package streisand
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bertha/streisand/diskstore"
+)
+
+// metadata is optional information about a blob that's given when uploading
+// it. It's stored in a sidecar next to the blob and replicated along with it.
+// Blobs in a namespace have their own metadata in every namespace, stored
+// next to the namespace's reference, so that namespaces can't see or
+// overwrite each other's.
+type metadata struct {
+	ContentType string            `json:"content_type,omitempty"`
+	Filename    string            `json:"filename,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+// metaHeaderPrefix is the prefix of the headers that set and return custom
+// metadata, in canonical form.
+const metaHeaderPrefix = "X-Streisand-Meta-"
+
+// metadataFromRequest reads the metadata of an upload from the Content-Type,
+// X-StreiSANd-Filename and X-StreiSANd-Meta-* headers. It returns nil if the
+// request has none.
+func metadataFromRequest(r *http.Request) (*metadata, error) {
+	var md metadata
+	// curl sends this by default, so it doesn't mean anything.
+	if ct := r.Header.Get("Content-Type"); ct != "" && ct != "application/x-www-form-urlencoded" {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			return nil, fmt.Errorf("invalid Content-Type: %w", err)
+		}
+		md.ContentType = ct
+	}
+	md.Filename = r.Header.Get("X-StreiSANd-Filename")
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, metaHeaderPrefix) && len(k) > len(metaHeaderPrefix) {
+			if md.Extra == nil {
+				md.Extra = map[string]string{}
+			}
+			md.Extra[strings.ToLower(k[len(metaHeaderPrefix):])] = v[0]
+		}
+	}
+	if md.ContentType == "" && md.Filename == "" && md.Extra == nil {
+		return nil, nil
+	}
+	return &md, nil
+}
+
+// setHeaders serves md as Content-Type, Content-Disposition and
+// X-StreiSANd-Meta-* headers.
+func (md *metadata) setHeaders(hdrs http.Header) {
+	if md.ContentType != "" {
+		hdrs.Set("Content-Type", md.ContentType)
+	}
+	if md.Filename != "" {
+		hdrs.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": md.Filename}))
+	}
+	for k, v := range md.Extra {
+		hdrs.Set(metaHeaderPrefix+k, v)
+	}
+}
+
+// encode and decodeMetadata convert metadata to and from the
+// X-StreiSANd-Metadata header that's used between peers.
+func (md *metadata) encode() (string, error) {
+	b, err := json.Marshal(md)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func decodeMetadata(v string) (*metadata, error) {
+	if v == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	var md metadata
+	if err := json.Unmarshal(b, &md); err != nil {
+		return nil, err
+	}
+	return &md, nil
+}
+
+// readMetadata returns the metadata of the blob with the given hash in ns,
+// which may be nil, or nil if it has none.
+func (s *server) readMetadata(ns *namespace, hash []byte) (*metadata, error) {
+	store, key, err := s.metadataStore(ns, hash)
+	if err != nil {
+		return nil, err
+	}
+	b, err := store.ReadMeta(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var md metadata
+	if err := json.Unmarshal(b, &md); err != nil {
+		return nil, fmt.Errorf("corrupt metadata: %w", err)
+	}
+	return &md, nil
+}
+
+// writeMetadata stores md for the blob with the given hash in ns, which may
+// be nil, replacing any earlier metadata. Passing nil is a no-op.
+func (s *server) writeMetadata(ns *namespace, hash []byte, md *metadata) error {
+	if md == nil {
+		return nil
+	}
+	store, key, err := s.metadataStore(ns, hash)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	return store.WriteMeta(key, b)
+}
+
+// metadataStore returns the store that holds the metadata of the blob with
+// the given hash in ns, and the blob's key in it.
+func (s *server) metadataStore(ns *namespace, hash []byte) (*diskstore.Store, []byte, error) {
+	if ns != nil {
+		return ns.refs, hash, nil
+	}
+	hs, digest, err := s.lookup(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hs.store, digest, nil
+}
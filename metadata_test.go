@@ -0,0 +1,71 @@
+package streisand
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	peer := newTestServer(t)
+	hs := httptest.NewServer(peer)
+	defer hs.Close()
+	s, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		GetPeers: func() ([]*url.URL, error) {
+			return mustParseURLs(t, hs.URL), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("report"))
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("X-StreiSANd-Filename", "rapport é.txt")
+	req.Header.Set("X-StreiSANd-Meta-Author", "Bertha")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("upload returned %d: %s", w.Code, w.Body)
+	}
+	hash := w.Body.String()
+
+	check := func(name string, srv Server) {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+hash, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s: GET returned %d", name, w.Code)
+		}
+		for h, want := range map[string]string{
+			"Content-Type":            "text/plain; charset=utf-8",
+			"Content-Disposition":     "inline; filename*=utf-8''rapport%20%C3%A9.txt",
+			"X-StreiSANd-Meta-Author": "Bertha",
+		} {
+			if got := w.Header().Get(h); got != want {
+				t.Errorf("%s: %s = %q, want %q", name, h, got, want)
+			}
+		}
+	}
+	check("uploaded to", s)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for s.(*server).outbox.pending(hs.URL) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("blob wasn't replicated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	check("replicated to", peer)
+
+	html := upload(t, s, "<html><body>hi</body></html>")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+html, nil))
+	if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("sniffed Content-Type = %q", got)
+	}
+}
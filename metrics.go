@@ -0,0 +1,250 @@
+package streisand
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics holds the counters exported on /metrics in the Prometheus text
+// exposition format. All fields are updated atomically.
+type metrics struct {
+	uploads, downloads          uint64
+	uploadShortCircuits         uint64
+	bytesIn, bytesOut           uint64
+	notFound                    uint64
+	internalUploadConflicts     uint64
+	xorRepairs                  uint64
+	corruptBlobs                uint64
+	blobs, storeBytes           int64
+	readLockWait, writeLockWait uint64 // nanoseconds
+	readLocks, writeLocks       uint64
+
+	peersMutex sync.Mutex
+	peers      map[string]*peerMetrics
+}
+
+type peerMetrics struct {
+	pushSuccess, pushFailure, pushNanos uint64
+	pullSuccess, pullFailure, pullNanos uint64
+}
+
+func (m *metrics) peer(peer string) *peerMetrics {
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+	if m.peers == nil {
+		m.peers = map[string]*peerMetrics{}
+	}
+	pm, ok := m.peers[peer]
+	if !ok {
+		pm = &peerMetrics{}
+		m.peers[peer] = pm
+	}
+	return pm
+}
+
+// observePush records the outcome of a pushBlob that started at start.
+func (m *metrics) observePush(peer string, start time.Time, err error) {
+	pm := m.peer(peer)
+	atomic.AddUint64(&pm.pushNanos, uint64(time.Since(start)))
+	if err != nil {
+		atomic.AddUint64(&pm.pushFailure, 1)
+	} else {
+		atomic.AddUint64(&pm.pushSuccess, 1)
+	}
+}
+
+// observePull records the outcome of a pullBlob that started at start.
+func (m *metrics) observePull(peer string, start time.Time, err error) {
+	pm := m.peer(peer)
+	atomic.AddUint64(&pm.pullNanos, uint64(time.Since(start)))
+	if err != nil {
+		atomic.AddUint64(&pm.pullFailure, 1)
+	} else {
+		atomic.AddUint64(&pm.pullSuccess, 1)
+	}
+}
+
+// addBlob records that a new blob of the given size was stored.
+func (m *metrics) addBlob(size int64) {
+	atomic.AddInt64(&m.blobs, 1)
+	atomic.AddInt64(&m.storeBytes, size)
+}
+
+type sample struct {
+	labels string
+	value  float64
+}
+
+func writeFamily(w io.Writer, name, typ, help string, samples ...sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %v\n", name, s.labels, s.value)
+	}
+}
+
+func load(v *uint64) float64 {
+	return float64(atomic.LoadUint64(v))
+}
+
+func loadSeconds(v *uint64) float64 {
+	return time.Duration(atomic.LoadUint64(v)).Seconds()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labels(kv ...string) string {
+	parts := make([]string, 0, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, kv[i], labelEscaper.Replace(kv[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// writeTo writes all metrics in the Prometheus text exposition format.
+func (m *metrics) writeTo(w io.Writer) {
+	writeFamily(w, "streisand_uploads_total", "counter",
+		"Number of blobs uploaded through /upload.",
+		sample{"", load(&m.uploads)})
+	writeFamily(w, "streisand_upload_short_circuits_total", "counter",
+		"Number of uploads with an expected hash we already had, whose body wasn't read.",
+		sample{"", load(&m.uploadShortCircuits)})
+	writeFamily(w, "streisand_downloads_total", "counter",
+		"Number of blobs served through /blob/.",
+		sample{"", load(&m.downloads)})
+	writeFamily(w, "streisand_received_bytes_total", "counter",
+		"Number of blob bytes received.",
+		sample{"", load(&m.bytesIn)})
+	writeFamily(w, "streisand_sent_bytes_total", "counter",
+		"Number of blob bytes sent.",
+		sample{"", load(&m.bytesOut)})
+	writeFamily(w, "streisand_not_found_total", "counter",
+		"Number of requests for blobs that weren't found.",
+		sample{"", load(&m.notFound)})
+	writeFamily(w, "streisand_internal_upload_conflicts_total", "counter",
+		"Number of internal uploads of blobs we already had.",
+		sample{"", load(&m.internalUploadConflicts)})
+	writeFamily(w, "streisand_xor_repairs_total", "counter",
+		"Number of repairs made to the xor tree.",
+		sample{"", load(&m.xorRepairs)})
+	writeFamily(w, "streisand_corrupt_blobs_total", "counter",
+		"Number of corrupt blobs that were quarantined.",
+		sample{"", load(&m.corruptBlobs)})
+	writeFamily(w, "streisand_blobs", "gauge",
+		"Number of blobs in the store.",
+		sample{"", float64(atomic.LoadInt64(&m.blobs))})
+	writeFamily(w, "streisand_store_bytes", "gauge",
+		"Total size of the blobs in the store.",
+		sample{"", float64(atomic.LoadInt64(&m.storeBytes))})
+	writeFamily(w, "streisand_lock_wait_seconds_total", "counter",
+		"Time spent waiting for the server locks.",
+		sample{labels("mode", "read"), loadSeconds(&m.readLockWait)},
+		sample{labels("mode", "write"), loadSeconds(&m.writeLockWait)})
+	writeFamily(w, "streisand_lock_acquisitions_total", "counter",
+		"Number of times the server locks were acquired.",
+		sample{labels("mode", "read"), load(&m.readLocks)},
+		sample{labels("mode", "write"), load(&m.writeLocks)})
+
+	m.peersMutex.Lock()
+	peers := make([]string, 0, len(m.peers))
+	for p := range m.peers {
+		peers = append(peers, p)
+	}
+	m.peersMutex.Unlock()
+	sort.Strings(peers)
+
+	var transfers, seconds, counts []sample
+	for _, p := range peers {
+		pm := m.peer(p)
+		transfers = append(transfers,
+			sample{labels("peer", p, "op", "push", "result", "success"), load(&pm.pushSuccess)},
+			sample{labels("peer", p, "op", "push", "result", "failure"), load(&pm.pushFailure)},
+			sample{labels("peer", p, "op", "pull", "result", "success"), load(&pm.pullSuccess)},
+			sample{labels("peer", p, "op", "pull", "result", "failure"), load(&pm.pullFailure)})
+		seconds = append(seconds,
+			sample{labels("peer", p, "op", "push"), loadSeconds(&pm.pushNanos)},
+			sample{labels("peer", p, "op", "pull"), loadSeconds(&pm.pullNanos)})
+		counts = append(counts,
+			sample{labels("peer", p, "op", "push"), load(&pm.pushSuccess) + load(&pm.pushFailure)},
+			sample{labels("peer", p, "op", "pull"), load(&pm.pullSuccess) + load(&pm.pullFailure)})
+	}
+	writeFamily(w, "streisand_peer_transfers_total", "counter",
+		"Number of blob transfers to and from peers.", transfers...)
+	writeFamily(w, "streisand_peer_transfer_seconds", "summary",
+		"Latency of blob transfers to and from peers.")
+	for _, s := range seconds {
+		fmt.Fprintf(w, "streisand_peer_transfer_seconds_sum%s %v\n", s.labels, s.value)
+	}
+	for _, s := range counts {
+		fmt.Fprintf(w, "streisand_peer_transfer_seconds_count%s %v\n", s.labels, s.value)
+	}
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.writeTo(w)
+}
+
+// storeRecountInterval is how often countStore counts the stores again.
+const storeRecountInterval = 24 * time.Hour
+
+// countStore sets the blob count and store size gauges, after starting and
+// then every storeRecountInterval. It runs in the background and replaces
+// whatever was counted meanwhile, so blobs that are added or removed while it
+// runs can be off until the next count.
+func (s *server) countStore() {
+	defer s.background.Done()
+	ctx, cancel := s.stopContext(context.Background())
+	defer cancel()
+	t := time.NewTicker(storeRecountInterval)
+	defer t.Stop()
+	for {
+		if !s.countStoreOnce(ctx) {
+			return
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// countStoreOnce counts the stores and sets the gauges. It returns false if
+// ctx was canceled before it was done.
+func (s *server) countStoreOnce(ctx context.Context) bool {
+	var blobs, size int64
+	for _, hs := range s.hashStores {
+		b, sz, err := hs.store.Usage(ctx)
+		if ctx.Err() != nil {
+			return false
+		}
+		if err != nil {
+			s.log.Warn("counting blobs in store failed", "algorithm", hs.algo.Name, "err", err)
+			continue
+		}
+		blobs += b
+		size += sz
+	}
+	atomic.StoreInt64(&s.metrics.blobs, blobs)
+	atomic.StoreInt64(&s.metrics.storeBytes, size)
+	return true
+}
+
+// countingReader counts the bytes read through it into n.
+type countingReader struct {
+	io.ReadCloser
+	n *uint64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
@@ -0,0 +1,70 @@
+package streisand
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t)
+	hash := upload(t, s, "test")
+
+	for _, path := range []string{"/blob/" + hash, "/blob/" + strings.Repeat("0", 64)} {
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 {
+		t.Fatalf("GET /metrics: %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"streisand_uploads_total 1\n",
+		"streisand_downloads_total 1\n",
+		"streisand_received_bytes_total 4\n",
+		"streisand_sent_bytes_total 4\n",
+		"streisand_not_found_total 1\n",
+		"# TYPE streisand_blobs gauge\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics doesn't contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestCountStore(t *testing.T) {
+	conf := ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+	}
+	s, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"a", "bb", "ccc"} {
+		upload(t, s, data)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The blobs that are already stored are counted once after restarting.
+	s, err = NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for s.Stats().Blobs == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("blobs were never counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := s.Stats(); st.Blobs != 3 || st.Bytes != 6 {
+		t.Errorf("counted %d blobs of %d bytes, want 3 of 6", st.Blobs, st.Bytes)
+	}
+}
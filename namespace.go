@@ -0,0 +1,164 @@
+package streisand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+	"github.com/bertha/streisand/diskstore"
+)
+
+// NamespaceConfig configures a namespace. Blobs are only visible in the
+// namespaces that they were uploaded to, and count towards the quota of each
+// of them, while the store keeps a single copy.
+type NamespaceConfig struct {
+	// MaxBytes and MaxBlobs limit the total size and the number of blobs in
+	// the namespace. Zero means unlimited.
+	MaxBytes, MaxBlobs int64
+}
+
+var errQuotaExceeded = errors.New("namespace quota exceeded")
+
+var validNamespace = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// namespace keeps track of the blobs referenced by a namespace. The refs
+// store holds an empty file for every blob. bytes and blobs are guarded by
+// mutex, which must be held across checking the quota and adding a blob.
+type namespace struct {
+	name string
+	conf NamespaceConfig
+	refs *diskstore.Store
+
+	mutex        sync.Mutex
+	bytes, blobs int64
+}
+
+// initNamespaces opens the configured namespaces and computes their usage.
+func (s *server) initNamespaces() error {
+	if s.conf.Namespaces == nil {
+		return nil
+	}
+	s.namespaces = map[string]*namespace{}
+	for name, nc := range s.conf.Namespaces {
+		if !validNamespace.MatchString(name) {
+			return fmt.Errorf("invalid namespace name %q", name)
+		}
+		ns := &namespace{
+			name: name,
+			conf: nc,
+			refs: &diskstore.Store{
+				// The blob store ignores this directory, because its
+				// name isn't valid hex.
+				Path:          filepath.Join(s.conf.DataDir, "namespaces", name),
+				BitsPerFolder: s.store.BitsPerFolder,
+				Fsync:         s.conf.WithFsync,
+			},
+		}
+		ns.refs.Initialize()
+		if err := os.MkdirAll(ns.refs.Path, 0777); err != nil {
+			return err
+		}
+		if _, err := ns.refs.Migrate(); err != nil {
+			return fmt.Errorf("namespace %s: %w", name, err)
+		}
+		var statErr error
+		if err := ns.refs.Scan(context.Background(), nil, 0, func(hash []byte) {
+			path, err := s.blobPath(hash)
+			if err != nil {
+				statErr = err
+				return
+			}
+			st, err := os.Stat(path)
+			if err != nil {
+				statErr = err
+				return
+			}
+			ns.blobs++
+			ns.bytes += st.Size()
+		}); err != nil {
+			return fmt.Errorf("namespace %s: %w", name, err)
+		}
+		if statErr != nil && !os.IsNotExist(statErr) {
+			return fmt.Errorf("namespace %s: %w", name, statErr)
+		}
+		s.namespaces[name] = ns
+	}
+	return nil
+}
+
+// namespaceFor returns the namespace named in the X-StreiSANd-Namespace
+// header. It returns nil if namespaces are disabled, and an error response if
+// the namespace is missing or unknown.
+func (s *server) namespaceFor(r *http.Request) (*namespace, convreq.HttpResponse) {
+	if s.namespaces == nil {
+		return nil, nil
+	}
+	name := r.Header.Get("X-StreiSANd-Namespace")
+	if name == "" {
+		return nil, respond.BadRequest("missing X-StreiSANd-Namespace")
+	}
+	ns, ok := s.namespaces[name]
+	if !ok {
+		return nil, respond.NotFound("unknown namespace")
+	}
+	return ns, nil
+}
+
+// checkQuota returns errQuotaExceeded if adding the blob would put the
+// namespace over its quota. Blobs already in the namespace are always fine.
+func (ns *namespace) checkQuota(hash []byte, size int64) error {
+	has, err := ns.refs.Has(hash)
+	if err != nil || has {
+		return err
+	}
+	if ns.conf.MaxBlobs > 0 && ns.blobs+1 > ns.conf.MaxBlobs {
+		return errQuotaExceeded
+	}
+	if ns.conf.MaxBytes > 0 && ns.bytes+size > ns.conf.MaxBytes {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// reference adds the blob to the namespace.
+func (ns *namespace) reference(hash []byte, size int64) error {
+	isNew, err := ns.refs.Mark(hash)
+	if err != nil {
+		return err
+	}
+	if isNew {
+		ns.blobs++
+		ns.bytes += size
+	}
+	return nil
+}
+
+// referenceExisting adds a blob that's already in the store to ns. If
+// enforceQuota is set, it fails with errQuotaExceeded if that would exceed
+// the quota of ns.
+func (s *server) referenceExisting(ns *namespace, hash []byte, enforceQuota bool) error {
+	hs, digest, err := s.lookup(hash)
+	if err != nil {
+		return err
+	}
+	defer s.lockBlob(hs, digest)()
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	st, err := os.Stat(hs.store.FullPath(digest))
+	if err != nil {
+		return err
+	}
+	if enforceQuota {
+		if err := ns.checkQuota(hash, st.Size()); err != nil {
+			return err
+		}
+	}
+	return ns.reference(hash, st.Size())
+}
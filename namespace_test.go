@@ -0,0 +1,110 @@
+package streisand
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNamespaces(t *testing.T) {
+	s, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		Namespaces: map[string]NamespaceConfig{
+			"alice": {MaxBlobs: 1},
+			"bob":   {MaxBytes: 10},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	do := func(method, path, ns string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, body)
+		if ns != "" {
+			req.Header.Set("X-StreiSANd-Namespace", ns)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/upload", "alice", strings.NewReader("test"))
+	if w.Code != 200 {
+		t.Fatalf("upload to alice: %d: %s", w.Code, w.Body)
+	}
+	hash := w.Body.String()
+
+	if w := do("GET", "/blob/"+hash, "alice", nil); w.Code != 200 {
+		t.Errorf("GET from alice: %d", w.Code)
+	}
+	if w := do("GET", "/blob/"+hash, "bob", nil); w.Code != 404 {
+		t.Errorf("GET from bob: %d, want 404", w.Code)
+	}
+	if w := do("GET", "/blob/"+hash, "", nil); w.Code != 400 {
+		t.Errorf("GET without namespace: %d, want 400", w.Code)
+	}
+	if w := do("GET", "/list", "bob", nil); !strings.HasPrefix(w.Body.String(), "0 entries") {
+		t.Errorf("list of bob: %q", w.Body)
+	}
+
+	// Uploading the same blob again doesn't count against the quota.
+	if w := do("POST", "/upload", "alice", strings.NewReader("test")); w.Code != 200 {
+		t.Errorf("reupload to alice: %d: %s", w.Code, w.Body)
+	}
+	if w := do("POST", "/upload", "alice", strings.NewReader("other")); w.Code != 507 {
+		t.Errorf("upload over blob quota: %d, want 507", w.Code)
+	}
+
+	// bob may have the blob alice uploaded too.
+	if w := do("POST", "/upload", "bob", strings.NewReader("test")); w.Code != 200 {
+		t.Errorf("upload to bob: %d: %s", w.Code, w.Body)
+	}
+	if w := do("GET", "/blob/"+hash, "bob", nil); w.Code != 200 {
+		t.Errorf("GET from bob after upload: %d", w.Code)
+	}
+	if w := do("POST", "/upload", "bob", strings.NewReader("0123456789")); w.Code != 507 {
+		t.Errorf("upload over byte quota: %d, want 507", w.Code)
+	}
+}
+
+func TestNamespaceMetadata(t *testing.T) {
+	s, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		Namespaces: map[string]NamespaceConfig{
+			"alice": {},
+			"bob":   {},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var hash string
+	for _, ns := range []string{"alice", "bob"} {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("test"))
+		req.Header.Set("X-StreiSANd-Namespace", ns)
+		req.Header.Set("X-StreiSANd-Filename", ns+".txt")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("upload to %s: %d: %s", ns, w.Code, w.Body)
+		}
+		hash = w.Body.String()
+	}
+
+	// Bob's upload of the same blob doesn't replace Alice's metadata.
+	for _, ns := range []string{"alice", "bob"} {
+		req := httptest.NewRequest("GET", "/blob/"+hash, nil)
+		req.Header.Set("X-StreiSANd-Namespace", ns)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if got := w.Header().Get("Content-Disposition"); !strings.Contains(got, ns+".txt") {
+			t.Errorf("GET from %s has Content-Disposition %q", ns, got)
+		}
+	}
+}
@@ -0,0 +1,496 @@
+package streisand
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+	"github.com/bertha/streisand/diskstore"
+)
+
+const (
+	// outboxInterval is how often the outbox is checked for peers to push to.
+	outboxInterval = time.Second
+	// outboxMinBackoff and outboxMaxBackoff bound the time we wait before
+	// retrying a peer after a failed push.
+	outboxMinBackoff = time.Second
+	outboxMaxBackoff = 5 * time.Minute
+	// outboxDepartedGrace is how long a peer may be missing from GetPeers
+	// before the blobs queued for it are queued for the peers that should
+	// store them now instead.
+	outboxDepartedGrace = time.Hour
+)
+
+// outbox is a persistent queue of blobs that still need to be pushed to
+// each peer. Every peer has a directory in CacheDir/outbox, named after its
+// escaped URL, with an empty file per blob. Blobs that were uploaded to a
+// namespace have the namespace appended to their file name after a dot.
+type outbox struct {
+	dir   string
+	fsync bool
+
+	mutex sync.Mutex
+	peers map[string]*outboxPeer
+}
+
+type outboxPeer struct {
+	url     *url.URL
+	dir     string
+	pending int
+
+	draining    bool
+	failures    int
+	nextAttempt time.Time
+	lastError   error
+	// goneSince is when the peer was first missing from GetPeers, or zero
+	// if it's still there.
+	goneSince time.Time
+}
+
+type outboxEntry struct {
+	name      string
+	hash      []byte
+	namespace string
+}
+
+func openOutbox(dir string, fsync bool) (*outbox, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	o := &outbox{
+		dir:   dir,
+		fsync: fsync,
+		peers: map[string]*outboxPeer{},
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, de := range des {
+		if !de.IsDir() {
+			continue
+		}
+		raw, err := url.QueryUnescape(de.Name())
+		if err != nil {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		op := o.peer(u)
+		entries, err := op.entries()
+		if err != nil {
+			return nil, err
+		}
+		op.pending = len(entries)
+	}
+	return o, nil
+}
+
+// peer returns the state of peer. o.mutex must be held, except during
+// openOutbox.
+func (o *outbox) peer(peer *url.URL) *outboxPeer {
+	key := peer.String()
+	op, ok := o.peers[key]
+	if !ok {
+		op = &outboxPeer{
+			url: peer,
+			dir: filepath.Join(o.dir, url.QueryEscape(key)),
+		}
+		o.peers[key] = op
+	}
+	return op
+}
+
+// enqueue durably records that hash must be pushed to peer.
+func (o *outbox) enqueue(peer *url.URL, hash []byte, namespace string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	op := o.peer(peer)
+	if err := os.MkdirAll(op.dir, 0777); err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(filepath.Join(op.dir, outboxName(hash, namespace)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if o.fsync {
+		if err := diskstore.SyncDir(op.dir); err != nil {
+			return err
+		}
+	}
+	op.pending++
+	return nil
+}
+
+// remove drops hash from the queue for peer, because it was pushed to it
+// some other way.
+func (o *outbox) remove(peer *url.URL, hash []byte, namespace string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.removeLocked(o.peer(peer), outboxName(hash, namespace))
+}
+
+// removeLocked removes the entry with the given name. o.mutex must be held.
+func (o *outbox) removeLocked(op *outboxPeer, name string) error {
+	err := os.Remove(filepath.Join(op.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	op.pending--
+	return nil
+}
+
+// queued returns whether hash is still queued for any peer, in any
+// namespace.
+func (o *outbox) queued(hash []byte) (bool, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	name := outboxName(hash, "")
+	for _, op := range o.peers {
+		if op.pending == 0 {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(op.dir, name)); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+		matches, err := filepath.Glob(filepath.Join(op.dir, name+".*"))
+		if err != nil {
+			return false, err
+		}
+		if len(matches) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func outboxName(hash []byte, namespace string) string {
+	name := hex.EncodeToString(hash)
+	if namespace != "" {
+		name += "." + namespace
+	}
+	return name
+}
+
+// entries lists the blobs queued for the peer.
+func (op *outboxPeer) entries() ([]outboxEntry, error) {
+	des, err := os.ReadDir(op.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]outboxEntry, 0, len(des))
+	for _, de := range des {
+		parts := strings.SplitN(de.Name(), ".", 2)
+		h, err := hex.DecodeString(parts[0])
+		if err != nil {
+			continue
+		}
+		if _, _, err := splitKey(h); err != nil {
+			continue
+		}
+		e := outboxEntry{name: de.Name(), hash: h}
+		if len(parts) == 2 {
+			e.namespace = parts[1]
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+// due returns the peers that have blobs queued and aren't backing off or
+// being drained already, and marks them as being drained.
+func (o *outbox) due() []*outboxPeer {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	var ret []*outboxPeer
+	for _, op := range o.peers {
+		if op.pending > 0 && !op.draining && time.Now().After(op.nextAttempt) {
+			op.draining = true
+			ret = append(ret, op)
+		}
+	}
+	return ret
+}
+
+// finish records the outcome of draining op. If err is nil, the entry has
+// been pushed and is removed from the queue.
+func (o *outbox) finish(op *outboxPeer, e outboxEntry, err error) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if err != nil {
+		backoff := outboxMinBackoff << op.failures
+		if backoff > outboxMaxBackoff || backoff <= 0 {
+			backoff = outboxMaxBackoff
+		} else {
+			op.failures++
+		}
+		op.nextAttempt = time.Now().Add(backoff)
+		op.lastError = err
+		return nil
+	}
+	op.failures = 0
+	op.lastError = nil
+	return o.removeLocked(op, e.name)
+}
+
+// departed updates which peers are missing from peers, and returns the ones
+// with blobs queued that have been missing for longer than grace. They're
+// marked as being drained, like by due.
+func (o *outbox) departed(peers []*url.URL, grace time.Duration) []*outboxPeer {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	var ret []*outboxPeer
+	for _, op := range o.peers {
+		if containsURL(peers, op.url) {
+			op.goneSince = time.Time{}
+			continue
+		}
+		if op.goneSince.IsZero() {
+			op.goneSince = time.Now()
+		}
+		if op.pending > 0 && !op.draining && time.Since(op.goneSince) > grace {
+			op.draining = true
+			ret = append(ret, op)
+		}
+	}
+	return ret
+}
+
+func (o *outbox) doneDraining(op *outboxPeer) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	op.draining = false
+}
+
+// pending returns the number of blobs queued for peer.
+func (o *outbox) pending(peer string) int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if op, ok := o.peers[peer]; ok {
+		return op.pending
+	}
+	return 0
+}
+
+// total returns the number of blobs queued for all peers together.
+func (o *outbox) total() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	n := 0
+	for _, op := range o.peers {
+		n += op.pending
+	}
+	return n
+}
+
+// enqueueForPeers queues a blob that was uploaded to us for all peers that
+// should store it, and wakes up the outbox loop.
+func (s *server) enqueueForPeers(ctx context.Context, hash []byte, namespace string) {
+	targets, err := s.peersFor(hash)
+	if err != nil {
+		s.logger(ctx).Warn("getting peers to replicate to failed", "err", err)
+		return
+	}
+	for _, t := range targets {
+		if err := s.outbox.enqueue(t, hash, namespace); err != nil {
+			s.logger(ctx).Error("queueing blob for peer failed",
+				"peer", t.String(), "hash", hex.EncodeToString(hash), "err", err)
+		}
+	}
+	select {
+	case s.outboxKick <- struct{}{}:
+	default:
+	}
+}
+
+func (s *server) outboxLoop() {
+	defer s.background.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	var drains sync.WaitGroup
+	defer drains.Wait()
+	defer cancel()
+
+	t := time.NewTicker(outboxInterval)
+	defer t.Stop()
+	for {
+		for _, op := range s.outbox.due() {
+			drains.Add(1)
+			go func(op *outboxPeer) {
+				defer drains.Done()
+				defer s.outbox.doneDraining(op)
+				s.drainOutbox(ctx, op)
+			}(op)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			s.replaceDeparted(outboxDepartedGrace)
+		case <-s.outboxKick:
+		}
+	}
+}
+
+// replaceDeparted queues the blobs that are queued for peers that have been
+// gone from GetPeers for longer than grace for the peers that should store
+// them now, and drops them for the departed ones.
+func (s *server) replaceDeparted(grace time.Duration) {
+	if s.conf.GetPeers == nil {
+		return
+	}
+	peers, err := s.conf.GetPeers()
+	if err != nil {
+		return
+	}
+	for _, op := range s.outbox.departed(peers, grace) {
+		s.replaceOutbox(op)
+		s.outbox.doneDraining(op)
+	}
+}
+
+func (s *server) replaceOutbox(op *outboxPeer) {
+	entries, err := op.entries()
+	if err != nil {
+		s.log.Error("listing outbox failed", "peer", op.url.String(), "err", err)
+		return
+	}
+	s.log.Warn("peer is gone, queueing its blobs for other peers", "peer", op.url.String(), "blobs", len(entries))
+	for _, e := range entries {
+		targets, err := s.peersFor(e.hash)
+		if err != nil {
+			s.log.Warn("getting peers to replicate to failed", "err", err)
+			return
+		}
+		for _, t := range targets {
+			if err := s.outbox.enqueue(t, e.hash, e.namespace); err != nil {
+				s.log.Error("queueing blob for peer failed",
+					"peer", t.String(), "hash", hex.EncodeToString(e.hash), "err", err)
+				return
+			}
+		}
+		if err := s.outbox.remove(op.url, e.hash, e.namespace); err != nil {
+			s.log.Error("removing blob from outbox failed", "peer", op.url.String(), "err", err)
+			return
+		}
+	}
+}
+
+// drainOutbox pushes the blobs queued for op until it's empty or the peer
+// fails. Blobs that we don't have anymore are dropped, and blobs the peer
+// rejects stay queued without holding up the others.
+func (s *server) drainOutbox(ctx context.Context, op *outboxPeer) {
+	entries, err := op.entries()
+	if err != nil {
+		s.log.Error("listing outbox failed", "peer", op.url.String(), "err", err)
+		return
+	}
+	for _, e := range entries {
+		err := s.pushBlob(ctx, op.url, e.hash, e.namespace, nil)
+		if errors.Is(err, errBlobGone) {
+			s.log.Warn("dropping blob that's gone from outbox",
+				"peer", op.url.String(), "hash", hex.EncodeToString(e.hash), "err", err)
+			err = nil
+		}
+		if ferr := s.outbox.finish(op, e, err); ferr != nil {
+			s.log.Error("removing pushed blob from outbox failed",
+				"peer", op.url.String(), "err", ferr)
+			return
+		}
+		if errors.Is(err, errPushRejected) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		s.handOff(ctx, e.hash)
+	}
+}
+
+type outboxStatus struct {
+	Peer        string     `json:"peer"`
+	Pending     int        `json:"pending"`
+	Failures    int        `json:"failures"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Hashes      []string   `json:"hashes,omitempty"`
+}
+
+// handleOutbox shows the state of the outbox. With ?peer=<url>, it also
+// lists the blobs queued for that peer.
+func (s *server) handleOutbox(r *http.Request) convreq.HttpResponse {
+	if r.Method != "GET" {
+		return respond.MethodNotAllowed("Method Not Allowed")
+	}
+	only := r.URL.Query().Get("peer")
+	var ret []outboxStatus
+	s.outbox.mutex.Lock()
+	var list []*outboxPeer
+	for key, op := range s.outbox.peers {
+		if only != "" && key != only {
+			continue
+		}
+		st := outboxStatus{
+			Peer:     key,
+			Pending:  op.pending,
+			Failures: op.failures,
+		}
+		if time.Now().Before(op.nextAttempt) {
+			na := op.nextAttempt
+			st.NextAttempt = &na
+		}
+		if op.lastError != nil {
+			st.LastError = op.lastError.Error()
+		}
+		ret = append(ret, st)
+		list = append(list, op)
+	}
+	s.outbox.mutex.Unlock()
+
+	if only != "" {
+		if len(list) == 0 {
+			return respond.NotFound("no outbox for peer")
+		}
+		entries, err := list[0].entries()
+		if err != nil {
+			return respond.Error(err)
+		}
+		for _, e := range entries {
+			ret[0].Hashes = append(ret[0].Hashes, e.name)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Peer < ret[j].Peer
+	})
+	b, err := json.MarshalIndent(ret, "", "\t")
+	if err != nil {
+		return respond.Error(err)
+	}
+	return respond.WithHeader(respond.Bytes(b), "Content-Type", "application/json")
+}
@@ -0,0 +1,189 @@
+package streisand
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutboxPersistence(t *testing.T) {
+	dir := t.TempDir()
+	o, err := openOutbox(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := mustParseURLs(t, "http://peer:8080")[0]
+	hash := make([]byte, BytesPerHash)
+	hash[0] = 1
+	for i := 0; i < 2; i++ {
+		if err := o.enqueue(peer, hash, "ns"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := o.pending(peer.String()); n != 1 {
+		t.Errorf("pending after enqueueing twice = %d, want 1", n)
+	}
+
+	o, err = openOutbox(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := o.pending(peer.String()); n != 1 {
+		t.Fatalf("pending after reopening = %d, want 1", n)
+	}
+	entries, err := o.peers[peer.String()].entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || hex.EncodeToString(entries[0].hash) != hex.EncodeToString(hash) || entries[0].namespace != "ns" {
+		t.Errorf("entries after reopening = %+v", entries)
+	}
+}
+
+func TestOutboxRetries(t *testing.T) {
+	dst := newTestServer(t)
+	var up int32
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		dst.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+	peer := mustParseURLs(t, hs.URL)[0]
+
+	src, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		GetPeers: func() ([]*url.URL, error) {
+			return []*url.URL{peer}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	hash := upload(t, src, "test")
+
+	outboxState := func() outboxStatus {
+		w := httptest.NewRecorder()
+		src.ServeHTTP(w, httptest.NewRequest("GET", "/admin/outbox?peer="+url.QueryEscape(peer.String()), nil))
+		if w.Code != 200 {
+			t.Fatalf("GET /admin/outbox returned %d: %s", w.Code, w.Body)
+		}
+		var st []outboxStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+			t.Fatal(err)
+		}
+		return st[0]
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for st := outboxState(); st.LastError == ""; st = outboxState() {
+		if time.Now().After(deadline) {
+			t.Fatal("push to unavailable peer never failed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := outboxState(); st.Pending != 1 || len(st.Hashes) != 1 || st.Hashes[0] != hash {
+		t.Errorf("outbox after failed push: %+v", st)
+	}
+
+	atomic.StoreInt32(&up, 1)
+	for outboxState().Pending != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("outbox wasn't drained after the peer came back")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	dst.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+hash, nil))
+	if w.Code != 200 || w.Body.String() != "test" {
+		t.Errorf("peer doesn't have the blob: %d %q", w.Code, w.Body)
+	}
+}
+
+func TestOutboxDepartedPeer(t *testing.T) {
+	dst := newTestServer(t)
+	hs := httptest.NewServer(dst)
+	defer hs.Close()
+	gone := mustParseURLs(t, "http://127.0.0.1:1")
+	var peers atomic.Value
+	peers.Store(gone)
+	s, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		GetPeers: func() ([]*url.URL, error) {
+			return peers.Load().([]*url.URL), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	hash := upload(t, s, "test")
+
+	// Once the peer is gone, its blobs are queued for the new peer.
+	peers.Store(mustParseURLs(t, hs.URL))
+	deadline := time.Now().Add(10 * time.Second)
+	for s.(*server).outbox.pending(gone[0].String()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("blob is still queued for the departed peer")
+		}
+		s.(*server).replaceDeparted(0)
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		w := httptest.NewRecorder()
+		dst.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+hash, nil))
+		if w.Code == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("new peer never got the blob")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOutboxBlobGone(t *testing.T) {
+	dst := newTestServer(t)
+	hs := httptest.NewServer(dst)
+	defer hs.Close()
+	peer := mustParseURLs(t, hs.URL)[0]
+	s, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		GetPeers: StaticPeers(peer),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A blob that we don't have anymore is listed first, and mustn't hold
+	// up the others.
+	if err := s.(*server).outbox.enqueue(peer, make([]byte, BytesPerHash), ""); err != nil {
+		t.Fatal(err)
+	}
+	hash := upload(t, s, "test")
+	deadline := time.Now().Add(10 * time.Second)
+	for s.(*server).outbox.pending(peer.String()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("outbox wasn't drained")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	dst.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+hash, nil))
+	if w.Code != 200 {
+		t.Errorf("peer doesn't have the blob: %d", w.Code)
+	}
+}
@@ -0,0 +1,162 @@
+package streisand
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StaticPeers returns a PeersFunc that always returns the given peers.
+func StaticPeers(peers ...*url.URL) PeersFunc {
+	return func() ([]*url.URL, error) {
+		return peers, nil
+	}
+}
+
+// ParsePeers parses a list of peer URLs separated by commas or whitespace.
+func ParsePeers(list string) ([]*url.URL, error) {
+	var ret []*url.URL
+	for _, p := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}) {
+		u, err := url.Parse(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer URL %q: %w", p, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("peer URL %q must have a scheme and host", p)
+		}
+		ret = append(ret, u)
+	}
+	return ret, nil
+}
+
+// FilePeers returns a PeersFunc that reads the peers from a file with one
+// URL per line. Empty lines and lines starting with # are ignored. The file
+// is reread whenever its modification time changes, so membership can be
+// changed without restarting. If the file becomes unreadable or invalid, the
+// last good list is returned along with the error.
+func FilePeers(path string) PeersFunc {
+	var (
+		mutex   sync.Mutex
+		modTime time.Time
+		size    int64
+		peers   []*url.URL
+	)
+	return func() ([]*url.URL, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		st, err := os.Stat(path)
+		if err != nil {
+			return peers, err
+		}
+		if st.ModTime().Equal(modTime) && st.Size() == size {
+			return peers, nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return peers, err
+		}
+		var lines []string
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+		p, err := ParsePeers(strings.Join(lines, "\n"))
+		if err != nil {
+			return peers, fmt.Errorf("%s: %w", path, err)
+		}
+		peers, modTime, size = p, st.ModTime(), st.Size()
+		return peers, nil
+	}
+}
+
+// dnsRefresh is how long the results of DNS lookups are cached.
+const dnsRefresh = 30 * time.Second
+
+// cachedPeers caches the result of f for ttl. Errors aren't cached, and if f
+// fails the previous result is returned along with the error.
+func cachedPeers(f PeersFunc, ttl time.Duration) PeersFunc {
+	var (
+		mutex   sync.Mutex
+		fetched time.Time
+		peers   []*url.URL
+	)
+	return func() ([]*url.URL, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !fetched.IsZero() && time.Since(fetched) < ttl {
+			return peers, nil
+		}
+		p, err := f()
+		if err != nil {
+			return peers, err
+		}
+		peers, fetched = p, time.Now()
+		return peers, nil
+	}
+}
+
+// DNSSRVPeers returns a PeersFunc that looks up the SRV records of name, like
+// "_streisand._tcp.example.com", and returns a scheme://target:port URL for
+// each of them.
+func DNSSRVPeers(scheme, name string) PeersFunc {
+	return cachedPeers(func() ([]*url.URL, error) {
+		_, srvs, err := net.LookupSRV("", "", name)
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]*url.URL, len(srvs))
+		for i, srv := range srvs {
+			ret[i] = &url.URL{
+				Scheme: scheme,
+				Host:   net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), fmt.Sprint(srv.Port)),
+			}
+		}
+		return ret, nil
+	}, dnsRefresh)
+}
+
+// DNSHostPeers returns a PeersFunc that resolves host to its addresses and
+// returns a scheme://address:port URL for each of them.
+func DNSHostPeers(scheme, host, port string) PeersFunc {
+	return cachedPeers(func() ([]*url.URL, error) {
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]*url.URL, len(addrs))
+		for i, a := range addrs {
+			ret[i] = &url.URL{
+				Scheme: scheme,
+				Host:   net.JoinHostPort(a, port),
+			}
+		}
+		return ret, nil
+	}, dnsRefresh)
+}
+
+// ExcludeSelf returns a PeersFunc that returns the peers from f, without
+// self.
+func ExcludeSelf(f PeersFunc, self *url.URL) PeersFunc {
+	return func() ([]*url.URL, error) {
+		peers, err := f()
+		ret := make([]*url.URL, 0, len(peers))
+		for _, p := range peers {
+			if p.String() != self.String() {
+				ret = append(ret, p)
+			}
+		}
+		return ret, err
+	}
+}
@@ -0,0 +1,141 @@
+package streisand
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilePeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+	if err := os.WriteFile(path, []byte("# our peers\nhttp://a:1\n\nhttps://b:2/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := FilePeers(path)
+	peers, err := f()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0].String() != "http://a:1" || peers[1].String() != "https://b:2/" {
+		t.Errorf("FilePeers returned %v", peers)
+	}
+
+	if err := os.WriteFile(path, []byte("http://c:3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time changes on coarse filesystems.
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	peers, err = f()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].String() != "http://c:3" {
+		t.Errorf("FilePeers after change returned %v", peers)
+	}
+
+	if err := os.WriteFile(path, []byte("not a url\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	peers, err = f()
+	if err == nil || len(peers) != 1 {
+		t.Errorf("FilePeers with invalid file returned %v, %v; want the old list and an error", peers, err)
+	}
+}
+
+func TestExcludeSelf(t *testing.T) {
+	peers := mustParseURLs(t, "http://a:1", "http://b:1")
+	got, err := ExcludeSelf(StaticPeers(peers...), peers[1])()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != peers[0] {
+		t.Errorf("ExcludeSelf returned %v", got)
+	}
+}
+
+func TestGossip(t *testing.T) {
+	const n = 3
+	var (
+		servers [n]Server
+		urls    [n]*url.URL
+	)
+	for i := range servers {
+		hs := httptest.NewUnstartedServer(nil)
+		urls[i] = &url.URL{Scheme: "http", Host: hs.Listener.Addr().String()}
+		var err error
+		servers[i], err = NewServer(ServerConfig{
+			DataDir:  t.TempDir(),
+			CacheDir: t.TempDir(),
+			Self:     urls[i],
+			Gossip: &GossipConfig{
+				Seeds:    []*url.URL{urls[0]},
+				Interval: 10 * time.Millisecond,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs.Config.Handler = servers[i]
+		hs.Start()
+		defer hs.Close()
+		defer servers[i].Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, s := range servers {
+		for {
+			peers, err := s.(*server).conf.GetPeers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(peers) == n {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("gossip didn't converge: %s knows %v", s.(*server).conf.Self, peers)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestGossipTombstones(t *testing.T) {
+	g, err := newGossip(GossipConfig{Interval: time.Millisecond}, mustParseURLs(t, "http://self:1")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	known := func() bool {
+		_, ok := g.members["http://gone:1"]
+		return ok
+	}
+	g.merge(gossipMessage{Members: map[string]uint64{"http://gone:1": 5}})
+	if !known() {
+		t.Fatal("member wasn't added")
+	}
+	g.members["http://gone:1"].updated = time.Now().Add(-time.Hour)
+	g.tick()
+	if known() {
+		t.Fatal("member wasn't forgotten")
+	}
+
+	// Old heartbeats that are still going around don't bring it back,
+	// but newer ones do.
+	g.merge(gossipMessage{Members: map[string]uint64{"http://gone:1": 5}})
+	if known() {
+		t.Error("an old heartbeat brought back a forgotten member")
+	}
+	g.merge(gossipMessage{Members: map[string]uint64{"http://gone:1": 6}})
+	if !known() {
+		t.Error("a new heartbeat didn't bring back a forgotten member")
+	}
+}
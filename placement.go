@@ -0,0 +1,193 @@
+package streisand
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// Placement places every blob on a subset of the nodes instead of on all of
+// them. Blobs are placed by their hash prefix of PrefixBits bits using
+// rendezvous hashing over the peer URLs, so all blobs under a prefix live on
+// the same nodes, and two nodes can reconcile the prefixes they share by
+// comparing those subtrees of their xor trees.
+//
+// All nodes must agree on the Placement and on the URLs of the peers.
+type Placement struct {
+	// Replicas is the number of nodes that store each blob.
+	Replicas int
+	// PrefixBits is the length of the prefixes that are placed as a unit.
+	// It can't exceed the depth of the xor tree, should be a multiple of its
+	// layer depth, and defaults to 16.
+	PrefixBits uint
+}
+
+func (p Placement) prefixBits() uint {
+	if p.PrefixBits == 0 {
+		return 16
+	}
+	return p.PrefixBits
+}
+
+func rendezvousScore(peer *url.URL, prefix uint32) uint64 {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], prefix)
+	h := sha256.New()
+	h.Write([]byte(peer.String()))
+	h.Write(b[:])
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+// NodesForPrefix returns the nodes that store the blobs under prefix, which
+// is a number of PrefixBits bits.
+func (p Placement) NodesForPrefix(peers []*url.URL, prefix uint32) []*url.URL {
+	type scored struct {
+		peer  *url.URL
+		score uint64
+	}
+	ss := make([]scored, len(peers))
+	for i, peer := range peers {
+		ss[i] = scored{peer, rendezvousScore(peer, prefix)}
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].score > ss[j].score
+	})
+	n := p.Replicas
+	if n > len(ss) {
+		n = len(ss)
+	}
+	ret := make([]*url.URL, n)
+	for i := range ret {
+		ret[i] = ss[i].peer
+	}
+	return ret
+}
+
+// NodesFor returns the nodes that store h.
+func (p Placement) NodesFor(peers []*url.URL, h *Hash) []*url.URL {
+	return p.NodesForPrefix(peers, h.PrefixToNumber(p.prefixBits()))
+}
+
+// SharedPrefixes returns the prefixes that are stored on both a and b, which
+// are the only parts of the hash space those two nodes should reconcile. They
+// are returned in ascending order.
+func (p Placement) SharedPrefixes(peers []*url.URL, a, b *url.URL) []uint32 {
+	var ret []uint32
+	for prefix := uint64(0); prefix < 1<<p.prefixBits(); prefix++ {
+		nodes := p.NodesForPrefix(peers, uint32(prefix))
+		if containsURL(nodes, a) && containsURL(nodes, b) {
+			ret = append(ret, uint32(prefix))
+		}
+	}
+	return ret
+}
+
+// overlapsShared returns whether prefix number n of depth bits overlaps any
+// of the prefixes returned by SharedPrefixes.
+func (p Placement) overlapsShared(shared []uint32, n uint32, depth uint) bool {
+	bits := p.prefixBits()
+	if depth >= bits {
+		n >>= depth - bits
+		i := sort.Search(len(shared), func(i int) bool { return shared[i] >= n })
+		return i < len(shared) && shared[i] == n
+	}
+	lo, hi := uint64(n)<<(bits-depth), uint64(n+1)<<(bits-depth)
+	i := sort.Search(len(shared), func(i int) bool { return uint64(shared[i]) >= lo })
+	return i < len(shared) && uint64(shared[i]) < hi
+}
+
+func containsURL(urls []*url.URL, u *url.URL) bool {
+	for _, v := range urls {
+		if v.String() == u.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// ownsBlob returns whether we're one of the nodes that should store the blob
+// with the given address. If no node should, because GetPeers returned none,
+// we do, so that the blob isn't dropped.
+func (s *server) ownsBlob(key []byte) (bool, error) {
+	if s.conf.Placement == nil || s.conf.GetPeers == nil {
+		return true, nil
+	}
+	peers, err := s.conf.GetPeers()
+	if err != nil {
+		return false, err
+	}
+	nodes := s.conf.Placement.NodesFor(peers, keyHash(key))
+	return len(nodes) == 0 || containsURL(nodes, s.conf.Self), nil
+}
+
+// handOff drops our copy of a blob that was uploaded to us but that we don't
+// own, once it has been pushed to all of its owners. The blob then has as
+// many copies as Placement.Replicas, rather than one more.
+func (s *server) handOff(ctx context.Context, key []byte) {
+	ctx = withLogFields(ctx, "hash", hex.EncodeToString(key))
+	if owns, err := s.ownsBlob(key); err != nil {
+		s.logger(ctx).Warn("getting owners of blob failed", "err", err)
+		return
+	} else if owns {
+		return
+	}
+	if queued, err := s.outbox.queued(key); err != nil {
+		s.logger(ctx).Warn("checking outbox failed", "err", err)
+		return
+	} else if queued {
+		return
+	}
+	hs, digest, err := s.lookup(key)
+	if err != nil {
+		return
+	}
+	defer s.lockBlob(hs, digest)()
+	done, err := hs.xors.Prepare(xorHash(digest))
+	if err != nil {
+		s.logger(ctx).Error("handing off blob failed", "err", err)
+		return
+	}
+	defer done()
+	size, err := hs.store.Delete(digest)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		s.logger(ctx).Error("handing off blob failed", "err", err)
+		return
+	}
+	// Adding a hash to the xor tree again removes it.
+	hs.xors.Add(xorHash(digest))
+	atomic.AddInt64(&s.metrics.blobs, -1)
+	atomic.AddInt64(&s.metrics.storeBytes, -size)
+	s.logger(ctx).Debug("handed off blob to its owners")
+}
+
+// peersFor returns the peers that should store the blob with the given
+// address, excluding ourselves.
+func (s *server) peersFor(key []byte) ([]*url.URL, error) {
+	if s.conf.GetPeers == nil {
+		return nil, nil
+	}
+	peers, err := s.conf.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+	if s.conf.Placement != nil {
+		peers = s.conf.Placement.NodesFor(peers, keyHash(key))
+	}
+	ret := make([]*url.URL, 0, len(peers))
+	for _, p := range peers {
+		if s.conf.Self != nil && p.String() == s.conf.Self.String() {
+			continue
+		}
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
@@ -0,0 +1,269 @@
+package streisand
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParseURLs(t *testing.T, urls ...string) []*url.URL {
+	ret := make([]*url.URL, len(urls))
+	for i, u := range urls {
+		var err error
+		if ret[i], err = url.Parse(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ret
+}
+
+func TestPlacement(t *testing.T) {
+	peers := mustParseURLs(t, "http://a:1", "http://b:1", "http://c:1", "http://d:1")
+	p := Placement{Replicas: 2, PrefixBits: 8}
+
+	counts := map[string]int{}
+	for prefix := uint32(0); prefix < 256; prefix++ {
+		nodes := p.NodesForPrefix(peers, prefix)
+		if len(nodes) != 2 || nodes[0] == nodes[1] {
+			t.Fatalf("NodesForPrefix(%d) = %v", prefix, nodes)
+		}
+		// The order of the peers mustn't matter.
+		reversed := []*url.URL{peers[3], peers[2], peers[1], peers[0]}
+		if other := p.NodesForPrefix(reversed, prefix); other[0] != nodes[0] || other[1] != nodes[1] {
+			t.Fatalf("NodesForPrefix(%d) depends on the order of peers", prefix)
+		}
+		for _, n := range nodes {
+			counts[n.Host]++
+		}
+	}
+	for _, peer := range peers {
+		if c := counts[peer.Host]; c < 64 || c > 192 {
+			t.Errorf("%s got %d of 512 placements", peer, c)
+		}
+	}
+
+	shared := p.SharedPrefixes(peers, peers[0], peers[1])
+	for _, prefix := range shared {
+		nodes := p.NodesForPrefix(peers, prefix)
+		if !containsURL(nodes, peers[0]) || !containsURL(nodes, peers[1]) {
+			t.Errorf("prefix %d is placed on %v, not shared", prefix, nodes)
+		}
+	}
+	for prefix := uint32(0); prefix < 256; prefix++ {
+		nodes := p.NodesForPrefix(peers, prefix)
+		want := containsURL(nodes, peers[0]) && containsURL(nodes, peers[1])
+		if got := p.overlapsShared(shared, prefix, 8); got != want {
+			t.Errorf("overlapsShared(%d, 8) = %v", prefix, got)
+		}
+		if got := p.overlapsShared(shared, prefix<<4|7, 12); got != want {
+			t.Errorf("overlapsShared(%d, 12) = %v", prefix<<4|7, got)
+		}
+		if want && !p.overlapsShared(shared, prefix>>4, 4) {
+			t.Errorf("overlapsShared(%d, 4) = false", prefix>>4)
+		}
+	}
+}
+
+// blobOwnedBy returns the contents of a blob that placement puts on owner
+// first.
+func blobOwnedBy(placement *Placement, peers []*url.URL, owner *url.URL) string {
+	for i := 0; ; i++ {
+		data := fmt.Sprintf("blob %d", i)
+		h := Hash(sha256.Sum256([]byte(data)))
+		if placement.NodesFor(peers, &h)[0] == owner {
+			return data
+		}
+	}
+}
+
+func TestHandOff(t *testing.T) {
+	owner := newTestServer(t)
+	hs := httptest.NewServer(owner)
+	defer hs.Close()
+	peers := mustParseURLs(t, "http://self.invalid", hs.URL)
+	placement := &Placement{Replicas: 1}
+
+	if _, err := NewServer(ServerConfig{
+		DataDir:   t.TempDir(),
+		CacheDir:  t.TempDir(),
+		Placement: placement,
+	}); err == nil {
+		t.Error("NewServer accepted a Placement without Self")
+	}
+	for _, p := range []Placement{{Replicas: 0}, {Replicas: 1, PrefixBits: 28}} {
+		if _, err := NewServer(ServerConfig{
+			DataDir:   t.TempDir(),
+			CacheDir:  t.TempDir(),
+			Self:      peers[0],
+			Placement: &p,
+		}); err == nil {
+			t.Errorf("NewServer accepted %+v", p)
+		}
+	}
+	s, err := NewServer(ServerConfig{
+		DataDir:   t.TempDir(),
+		CacheDir:  t.TempDir(),
+		Self:      peers[0],
+		GetPeers:  StaticPeers(peers...),
+		Placement: placement,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Upload a blob that the other node owns.
+	data := blobOwnedBy(placement, peers, peers[1])
+	hash := upload(t, s, data)
+	h := Hash(sha256.Sum256([]byte(data)))
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		has, err := s.Has(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !has {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("blob was never handed off")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if has, err := owner.Has(h); err != nil || !has {
+		t.Errorf("owner doesn't have the blob: %v, %v", has, err)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+hash, nil))
+	if w.Code != 200 || w.Body.String() != data {
+		t.Errorf("GET after handing off returned %d: %q", w.Code, w.Body)
+	}
+}
+
+func TestForwardGetBlob(t *testing.T) {
+	has := newTestServer(t)
+	hs := httptest.NewServer(has)
+	defer hs.Close()
+
+	s, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		GetPeers: func() ([]*url.URL, error) {
+			return mustParseURLs(t, hs.URL), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	hash := upload(t, has, "test")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+hash, nil))
+	if w.Code != 200 || w.Body.String() != "test" {
+		t.Errorf("forwarded GET returned %d: %q", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/internal/blob/"+hash, nil))
+	if w.Code != 404 {
+		t.Errorf("internal GET was forwarded: %d", w.Code)
+	}
+}
+
+func TestForwardGetBlobNamespace(t *testing.T) {
+	has := newTestServer(t)
+	hs := httptest.NewServer(has)
+	defer hs.Close()
+
+	s, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		GetPeers: func() ([]*url.URL, error) {
+			return mustParseURLs(t, hs.URL), nil
+		},
+		Namespaces: map[string]NamespaceConfig{"alice": {}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	upload(t, has, "test")
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("test"))
+	req.Header.Set("X-StreiSANd-Namespace", "alice")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("upload returned %d: %s", w.Code, w.Body)
+	}
+	hash := w.Body.String()
+
+	// Drop our copy, but keep the namespace's reference to it.
+	key, _ := hex.DecodeString(hash)
+	store, digest, err := s.(*server).lookup(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.store.Delete(digest); err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest("GET", "/blob/"+hash, nil)
+	req.Header.Set("X-StreiSANd-Namespace", "alice")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != 200 || w.Body.String() != "test" {
+		t.Fatalf("forwarded GET returned %d: %q", w.Code, w.Body)
+	}
+	if cc := w.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "private") {
+		t.Errorf("forwarded namespaced blob has Cache-Control %q", cc)
+	}
+}
+
+func TestForwardGetBlobSlowPeer(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.NotFound(w, r)
+	}))
+	defer slow.Close()
+	defer close(release)
+	has := newTestServer(t)
+	hs := httptest.NewServer(has)
+	defer hs.Close()
+
+	peers := mustParseURLs(t, slow.URL, hs.URL)
+	s, err := NewServer(ServerConfig{
+		DataDir:     t.TempDir(),
+		CacheDir:    t.TempDir(),
+		GetPeers:    func() ([]*url.URL, error) { return peers, nil },
+		PeerTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The peer that has the blob answers without waiting for the slow one.
+	hash := upload(t, has, "test")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+hash, nil))
+	if w.Code != 200 || w.Body.String() != "test" {
+		t.Errorf("forwarded GET returned %d: %q", w.Code, w.Body)
+	}
+
+	// Peers that don't answer in time are given up on.
+	peers = peers[:1]
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+hash, nil))
+	if w.Code != 404 {
+		t.Errorf("GET from a slow peer returned %d, want 404", w.Code)
+	}
+}
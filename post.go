@@ -1,94 +1,322 @@
 package streisand
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/Jille/convreq"
 	"github.com/Jille/convreq/respond"
 )
 
+// errHashMismatch is returned when an upload doesn't match the hash the
+// client declared.
+var errHashMismatch = errors.New("content doesn't match the expected hash")
+
 func (s *server) handlePostBlob(r *http.Request) convreq.HttpResponse {
 	if r.Method != "POST" {
 		return respond.MethodNotAllowed("Method Not Allowed")
 	}
-	// TODO: Simultaneously sync it to peers.
+	var expected []byte
+	if v := r.Header.Get("X-StreiSANd-Expected-Hash"); v != "" {
+		var err error
+		if expected, err = hex.DecodeString(v); err != nil {
+			return respond.BadRequest("couldn't decode hash in X-StreiSANd-Expected-Hash")
+		}
+	}
+	return s.upload(r, expected)
+}
+
+// handlePutBlob handles PUT /blob/<hash>, which uploads a blob that must
+// have the given hash.
+func (s *server) handlePutBlob(r *http.Request) convreq.HttpResponse {
+	key, ok := httpPathToKey(r.URL.Path)
+	if !ok {
+		return respond.BadRequest("invalid hash")
+	}
+	return s.upload(r, key)
+}
 
-	hash, err := s.Post(r.Body)
+// upload stores the blob in the request body. If expected isn't nil, the
+// blob must have that address, and if we already have it the body isn't
+// read at all, so clients sending Expect: 100-continue don't send it.
+func (s *server) upload(r *http.Request, expected []byte) convreq.HttpResponse {
+	ns, resp := s.namespaceFor(r)
+	if resp != nil {
+		return resp
+	}
+	wc, err := parseWriteConcern(r)
+	if err != nil {
+		return respond.BadRequest(err.Error())
+	}
+	if wc.needsPeers() && s.conf.Self == nil {
+		// Without Self, GetPeers might return ourselves, and our own
+		// copy would be counted twice.
+		return respond.BadRequest("write concerns above local need the server to be configured with its own URL")
+	}
+	md, err := metadataFromRequest(r)
+	if err != nil {
+		return respond.BadRequest(err.Error())
+	}
+	var hs *hashStore
+	if expected != nil {
+		expected = normalizeKey(expected)
+		var digest []byte
+		if hs, digest, err = s.lookup(expected); err != nil {
+			return respond.BadRequest(err.Error())
+		}
+		has, err := hs.store.Has(digest)
+		if err != nil {
+			return respond.Error(err)
+		}
+		if has {
+			if ns != nil {
+				if err := s.referenceExisting(ns, expected, true); err == errQuotaExceeded {
+					return respond.InsufficientStorage(err.Error())
+				} else if err != nil {
+					return respond.Error(err)
+				}
+			}
+			atomic.AddUint64(&s.metrics.uploadShortCircuits, 1)
+			return s.finishUpload(r, expected, false, ns, md, wc)
+		}
+	} else if hs, err = s.hashStoreFor(r); err != nil {
+		return respond.BadRequest(err.Error())
+	}
+	hooks := &postHooks{}
+	if ns != nil {
+		hooks.locker = &ns.mutex
+		hooks.precommit = ns.checkQuota
+		hooks.postcommit = ns.reference
+	}
+	if expected != nil {
+		hooks.precommit = expectHash(expected, hooks.precommit)
+	}
+	hash, isNew, err := s.post(r.Context(), hs, s.limiter.clientReader(r.Body), hooks)
+	if err == errQuotaExceeded {
+		return respond.InsufficientStorage(err.Error())
+	}
+	if err == errHashMismatch {
+		return respond.BadRequest(err.Error())
+	}
 	if err != nil {
 		return respond.Error(err)
 	}
-	return respond.String(hex.EncodeToString(hash))
+	return s.finishUpload(r, hash, isNew, ns, md, wc)
+}
+
+// finishUpload stores the metadata of an upload, replicates it and responds
+// with its hash.
+func (s *server) finishUpload(r *http.Request, hash []byte, isNew bool, ns *namespace, md *metadata, wc writeConcern) convreq.HttpResponse {
+	if err := s.writeMetadata(ns, hash, md); err != nil {
+		return respond.Error(err)
+	}
+	var name string
+	if ns != nil {
+		name = ns.name
+	}
+	if isNew || ns != nil || wc.needsPeers() {
+		s.enqueueForPeers(r.Context(), hash, name)
+	}
+	atomic.AddUint64(&s.metrics.uploads, 1)
+	if !wc.needsPeers() {
+		return respond.String(hex.EncodeToString(hash))
+	}
+
+	// The blob is stored either way, so the hash is returned even if the
+	// write concern wasn't met. The outbox keeps trying to replicate it.
+	acked, err := s.awaitReplicas(r.Context(), hash, name, wc)
+	// The peers that acknowledged the upload may have been all of the
+	// owners, so our copy can go now that the response is decided.
+	s.handOff(r.Context(), hash)
+	ret := respond.WithHeader(respond.String(hex.EncodeToString(hash)),
+		"X-StreiSANd-Acknowledged-By", strings.Join(acked, ", "))
+	switch {
+	case err == errNotEnoughPeers:
+		return respond.OverrideResponseCode(ret, http.StatusServiceUnavailable)
+	case err != nil:
+		s.logger(r.Context()).Warn("write concern not met", "err", err)
+		return respond.OverrideResponseCode(ret, http.StatusGatewayTimeout)
+	}
+	return ret
 }
 
 func (s *server) handleInternalPostBlob(r *http.Request) convreq.HttpResponse {
 	if r.Method != "POST" {
 		return respond.MethodNotAllowed("Method Not Allowed")
 	}
-	var h Hash
-	n, err := hex.Decode(h[:], []byte(r.Header.Get("X-StreiSANd-Hash")))
+	key, err := hex.DecodeString(r.Header.Get("X-StreiSANd-Hash"))
 	if err != nil {
 		return respond.BadRequest("couldn't decode hash in X-StreiSANd-Hash")
 	}
-	if len(h) != n {
-		return respond.BadRequest("wrong hash length in X-StreiSANd-Hash")
+	key = normalizeKey(key)
+	hs, digest, err := s.lookup(key)
+	if err != nil {
+		return respond.BadRequest(fmt.Sprintf("X-StreiSANd-Hash: %v", err))
 	}
 
-	has, err := s.store.Has(h[:])
+	// Peers may name the namespace that references the blob, but quotas
+	// are only enforced on the node the client uploaded to.
+	ns, resp := s.namespaceFor(r)
+	if resp != nil {
+		return resp
+	}
+	md, err := decodeMetadata(r.Header.Get("X-StreiSANd-Metadata"))
+	if err != nil {
+		return respond.BadRequest("couldn't decode X-StreiSANd-Metadata")
+	}
+
+	has, err := hs.store.Has(digest)
 	if err != nil {
 		return respond.Error(err)
 	}
 	if has {
+		if err := s.writeMetadata(ns, key, md); err != nil {
+			return respond.Error(err)
+		}
+		if ns != nil {
+			if err := s.referenceExisting(ns, key, false); err != nil {
+				return respond.Error(err)
+			}
+		}
+
+		ctx := withLogFields(detach(r.Context()), "hash", hex.EncodeToString(key))
 		go func() {
-			warnOnErr(s.checkXorsumOf(&h),
-				"checking leaf xorsum of %s", &h)
+			if err := s.checkXorsumOf(ctx, hs, digest); err != nil {
+				s.logger(ctx).Warn("checking leaf xorsum failed", "err", err)
+			}
 		}()
 
+		atomic.AddUint64(&s.metrics.internalUploadConflicts, 1)
+
 		// TODO: See if there's a better code than HTTP 409 Conflict.
 		return respond.OverrideResponseCode(respond.String("already exists"), 409)
 	}
 
-	// TODO: abort if hash is not equal to h (X-StreiSANd-Hash)
-	hash, err := s.Post(r.Body)
+	hooks := &postHooks{precommit: expectHash(key, nil)}
+	if ns != nil {
+		hooks.locker = &ns.mutex
+		hooks.postcommit = ns.reference
+	}
+	hash, _, err := s.post(r.Context(), hs, r.Body, hooks)
+	if err == errHashMismatch {
+		return respond.BadRequest(err.Error())
+	}
 	if err != nil {
 		return respond.Error(err)
 	}
+	if err := s.writeMetadata(ns, hash, md); err != nil {
+		return respond.Error(err)
+	}
 	return respond.String(hex.EncodeToString(hash))
 }
 
-func (s *server) Post(blob io.ReadCloser) (hash []byte, err error) {
-	w, err := s.store.NewWriter()
+// expectHash returns a precommit hook that fails with errHashMismatch unless
+// the blob has the expected address, and then calls next if it's not nil.
+func expectHash(expected []byte, next func(hash []byte, size int64) error) func(hash []byte, size int64) error {
+	return func(hash []byte, size int64) error {
+		if !bytes.Equal(hash, expected) {
+			return errHashMismatch
+		}
+		if next != nil {
+			return next(hash, size)
+		}
+		return nil
+	}
+}
+
+func (s *server) Post(ctx context.Context, blob io.ReadCloser) (hash []byte, err error) {
+	hash, _, err = s.post(ctx, s.hashStores[SHA256.Code], blob, nil)
+	return
+}
+
+// postHooks are called by post while holding the blob's lock and locker (if
+// not nil), right before and right after the blob is committed to the store.
+// If precommit returns an error, the blob is discarded.
+type postHooks struct {
+	locker     sync.Locker
+	precommit  func(hash []byte, size int64) error
+	postcommit func(hash []byte, size int64) error
+}
+
+// post is like Post, but also returns whether the blob was new, and calls
+// hooks (if not nil) around committing the blob. If ctx is done before the
+// blob was read, it's discarded.
+func (s *server) post(ctx context.Context, hs *hashStore, blob io.ReadCloser, hooks *postHooks) (hash []byte, isNew bool, err error) {
+	w, err := hs.store.NewWriter()
 	if err != nil {
 		return
 	}
 	defer w.Abort()
 
-	if _, err = io.Copy(w, blob); err != nil {
+	n, err := io.Copy(w, contextReader{blob, ctx})
+	if err != nil {
 		return
 	}
-
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	atomic.AddUint64(&s.metrics.bytesIn, uint64(n))
 
 	if err = blob.Close(); err != nil {
 		return
 	}
 
+	defer s.lockBlob(hs, w.Sum())()
+	if hooks != nil && hooks.locker != nil {
+		hooks.locker.Lock()
+		defer hooks.locker.Unlock()
+	}
+
+	if hooks != nil && hooks.precommit != nil {
+		if err = hooks.precommit(hs.algo.key(w.Sum()), n); err != nil {
+			return
+		}
+	}
+
+	done, err := hs.xors.Prepare(xorHash(w.Sum()))
+	if err != nil {
+		return
+	}
+	defer done()
+
 	if err = w.Close(); err != nil {
 		return
 	}
 
-	hash = w.Hash()
+	hash = hs.algo.key(w.Hash())
+	isNew = w.IsNew()
+
+	if isNew {
+		hs.xors.Add(xorHash(w.Hash()))
+		s.metrics.addBlob(n)
+	}
 
-	if w.IsNew() {
-		s.xors.Add((*Hash)(hash))
+	if hooks != nil && hooks.postcommit != nil {
+		err = hooks.postcommit(hash, n)
 	}
 
 	return
 }
 
+// contextReader fails reads with ctx's error once ctx is done, so that a
+// canceled upload stops even if its body would still be read.
+type contextReader struct {
+	io.Reader
+	ctx context.Context
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.Reader.Read(p)
+}
+
 func (s *server) handleDebugAddXor(r *http.Request) convreq.HttpResponse {
 	if r.Method != "POST" {
 		return respond.MethodNotAllowed("Method Not Allowed")
@@ -102,32 +330,24 @@ func (s *server) handleDebugAddXor(r *http.Request) convreq.HttpResponse {
 		return respond.BadRequest("wrong hash length in X-StreiSANd-Hash")
 	}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	defer s.lockBlob(s.hashStores[SHA256.Code], h[:])()
 
 	s.xors.Add(&h)
 	xorsum := s.xors.GetLeaf(&h)
 	return respond.String(xorsum.String())
 }
 
-func (s *server) checkXorsumOf(h *Hash) (err error) {
-	if s.conf.Debug {
-		log.Printf("checking xorsum of %s", h)
-	}
+func (s *server) checkXorsumOf(ctx context.Context, hs *hashStore, digest []byte) (err error) {
+	h := xorHash(digest)
+	s.logger(ctx).Debug("checking xorsum", "hash", hex.EncodeToString(hs.algo.key(digest)))
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	defer s.lockBlob(hs, digest)()
 
 	// compute the difference between xorsum stored
 	// and the xorsum computed from the disk store
-	storedXorsum := s.xors.GetLeaf(h)
+	storedXorsum := hs.xors.GetLeaf(h)
 	var computedXorsum Hash
-
-	if err := s.store.Scan(h[:], uint8(s.xors.Depth()),
-		func(hash []byte) {
-			(*Hash)(hash).XorInto(computedXorsum[:])
-		}); err != nil {
-
+	if computedXorsum, err = hs.computeLeaf(ctx, h); err != nil {
 		return err
 	}
 
@@ -139,15 +359,18 @@ func (s *server) checkXorsumOf(h *Hash) (err error) {
 	}
 
 	if diff.Equals(h) {
-		log.Printf("warning: adding missing hash %s to xorsum", h)
-		s.xors.Add(h)
+		s.logger(ctx).Warn("adding missing hash to xorsum", "hash", hex.EncodeToString(hs.algo.key(digest)))
+		var done func()
+		if done, err = hs.xors.Prepare(h); err != nil {
+			return err
+		}
+		hs.xors.Add(h)
+		done()
+		atomic.AddUint64(&s.metrics.xorRepairs, 1)
 		return
 	}
 
 	// something serious is wrong;
-	panic("corrupted xorsum table")
-
 	// TODO: start repairing instead
-
-	return
+	panic("corrupted xorsum table")
 }
@@ -0,0 +1,103 @@
+package streisand
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bertha/streisand/diskstore"
+)
+
+// trackingReader records whether it has been read from.
+type trackingReader struct {
+	r    *strings.Reader
+	read int32
+}
+
+func (t *trackingReader) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&t.read, 1)
+	return t.r.Read(p)
+}
+
+func TestExpectedHash(t *testing.T) {
+	s := newTestServer(t)
+	sum := sha256.Sum256([]byte("data"))
+	hash := hex.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("other"))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/blob/"+hex.EncodeToString(other[:]), strings.NewReader("data")))
+	if w.Code != 400 {
+		t.Errorf("PUT with wrong hash returned %d", w.Code)
+	}
+	if n, _, _ := s.(*server).store.Usage(context.Background()); n != 0 {
+		t.Errorf("store has %d blobs after a mismatched upload", n)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/blob/"+hash, strings.NewReader("data")))
+	if w.Code != 200 || w.Body.String() != hash {
+		t.Errorf("PUT returned %d %q", w.Code, w.Body)
+	}
+
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 10 * time.Second}}
+	body := &trackingReader{r: strings.NewReader("data")}
+	req, err := http.NewRequest("POST", hs.URL+"/upload", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = 4
+	req.Header.Set("Expect", "100-continue")
+	req.Header.Set("X-StreiSANd-Expected-Hash", hash)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("upload of existing blob returned %s", resp.Status)
+	}
+	if atomic.LoadInt32(&body.read) != 0 {
+		t.Errorf("body of an upload of an existing blob was sent")
+	}
+}
+
+// cancelingReader cancels a context when it's read from.
+type cancelingReader struct {
+	cancel context.CancelFunc
+}
+
+func (c cancelingReader) Read(p []byte) (int, error) {
+	c.cancel()
+	return copy(p, "data"), nil
+}
+
+func TestPostCanceled(t *testing.T) {
+	s := newTestServer(t).(*server)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := s.Post(ctx, ioutil.NopCloser(cancelingReader{cancel})); !errors.Is(err, context.Canceled) {
+		t.Errorf("Post returned %v, want %v", err, context.Canceled)
+	}
+	// The writer was aborted, so nothing is left behind.
+	if err := filepath.WalkDir(s.conf.DataDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && d.Name() != diskstore.LayoutFile {
+			t.Errorf("%s exists after a canceled upload", path)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
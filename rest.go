@@ -2,14 +2,18 @@ package streisand
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"github.com/Jille/convreq"
 	"github.com/Jille/convreq/respond"
@@ -42,6 +46,53 @@ func (h *Hash) XorInto(s []byte) {
 	}
 }
 
+// AtomicXorInto is like XorInto, but safe to call concurrently on the same
+// slice. s must be 8-byte aligned.
+func (h *Hash) AtomicXorInto(s []byte) {
+	if len(s) != BytesPerHash {
+		panic("xoring hash into slice of incorrect size")
+	}
+	if uintptr(unsafe.Pointer(&s[0]))%8 != 0 {
+		panic("xoring hash atomically into unaligned slice")
+	}
+	// Xor works bytewise, so the byte order of the words doesn't matter
+	// as long as it's the same for both sides.
+	var words [BytesPerHash / 8]uint64
+	copy((*[BytesPerHash]byte)(unsafe.Pointer(&words))[:], h[:])
+	for i, w := range words {
+		p := (*uint64)(unsafe.Pointer(&s[8*i]))
+		for {
+			old := atomic.LoadUint64(p)
+			if atomic.CompareAndSwapUint64(p, old, old^w) {
+				break
+			}
+		}
+	}
+}
+
+// atomicLoadHash reads a hash from s one word at a time, so that it can be
+// read while AtomicXorInto updates it. The words may be from different
+// updates.
+func atomicLoadHash(s []byte) Hash {
+	var words [BytesPerHash / 8]uint64
+	for i := range words {
+		words[i] = atomic.LoadUint64((*uint64)(unsafe.Pointer(&s[8*i])))
+	}
+	var h Hash
+	copy(h[:], (*[BytesPerHash]byte)(unsafe.Pointer(&words))[:])
+	return h
+}
+
+// atomicStoreHash writes h into s one word at a time, so that it can be
+// written while the entry is read with atomicLoadHash.
+func atomicStoreHash(s []byte, h Hash) {
+	var words [BytesPerHash / 8]uint64
+	copy((*[BytesPerHash]byte)(unsafe.Pointer(&words))[:], h[:])
+	for i, w := range words {
+		atomic.StoreUint64((*uint64)(unsafe.Pointer(&s[8*i])), w)
+	}
+}
+
 func (h *Hash) Xor(other *Hash) Hash {
 	result := *other
 	h.XorInto(result[:])
@@ -63,21 +114,27 @@ func (h *Hash) PrefixToNumber(prefixLength uint) uint32 {
 	return p32 >> (32 - prefixLength)
 }
 
+// hashWithPrefix returns the lowest hash whose first prefixLength bits are n.
+func hashWithPrefix(n uint32, prefixLength uint) Hash {
+	var h Hash
+	if prefixLength > 0 {
+		binary.BigEndian.PutUint32(h[0:4], n<<(32-prefixLength))
+	}
+	return h
+}
+
 type Prefix struct {
 	Hash   Hash
 	Length int
 }
 
-func httpPathToHash(path string) (Hash, bool) {
-	var ret Hash
-	n, err := hex.Decode(ret[:], []byte(strings.TrimPrefix(strings.TrimPrefix(path, "/internal"), "/blob/")))
-	if err != nil {
-		return Hash{}, false
+// httpPathToKey returns the address of the blob in a /blob/ path.
+func httpPathToKey(path string) ([]byte, bool) {
+	key, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(path, "/internal"), "/blob/"))
+	if err != nil || len(key) == 0 {
+		return nil, false
 	}
-	if len(ret) != n {
-		return Hash{}, false
-	}
-	return ret, true
+	return normalizeKey(key), true
 }
 
 func (s *server) handleGetBlob(
@@ -86,31 +143,216 @@ func (s *server) handleGetBlob(
 	if r.Method != "GET" {
 		return respond.MethodNotAllowed("Method Not Allowed")
 	}
-	hash, ok := httpPathToHash(r.URL.Path)
+	key, ok := httpPathToKey(r.URL.Path)
 	if !ok {
 		return respond.BadRequest("invalid hash")
 	}
+	hs, digest, err := s.lookup(key)
+	if err != nil {
+		return respond.BadRequest(err.Error())
+	}
+	var ns *namespace
+	if allowForward {
+		var resp convreq.HttpResponse
+		if ns, resp = s.namespaceFor(r); resp != nil {
+			return resp
+		}
+	}
 
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	// Blobs are renamed into place once complete, so opening one needs no
+	// lock.
+	fh, err := s.openBlob(ns, hs, key, digest)
 
-	fh, err := s.store.Get(hash[:])
-	if os.IsNotExist(err) {
-		if allowForward {
-			// TODO try with another
+	if errors.Is(err, os.ErrNotExist) {
+		if allowForward && err != errNotInNamespace {
+			if resp := s.forwardGetBlob(r.Context(), ns, key); resp != nil {
+				return resp
+			}
 		}
+		atomic.AddUint64(&s.metrics.notFound, 1)
 		return respond.NotFound("blob not found")
 	}
+	if err != nil {
+		return respond.Error(err)
+	}
 	st, err := fh.Stat()
 	if err != nil {
+		fh.Close()
 		return respond.Error(err)
 	}
+	md, err := s.readMetadata(ns, key)
+	if err != nil {
+		fh.Close()
+		return respond.Error(err)
+	}
+	atomic.AddUint64(&s.metrics.downloads, 1)
 	hdrs := http.Header{}
 	hdrs.Set("Content-Length", fmt.Sprint(st.Size()))
+	hdrs.Set("X-Content-Type-Options", "nosniff")
+	if md != nil {
+		md.setHeaders(hdrs)
+		if !allowForward {
+			v, err := md.encode()
+			if err != nil {
+				fh.Close()
+				return respond.Error(err)
+			}
+			hdrs.Set("X-StreiSANd-Metadata", v)
+		}
+	}
+	if hdrs.Get("Content-Type") == "" {
+		hdrs.Set("Content-Type", sniffContentType(fh))
+	}
 	hdrs.Set("Last-Modified", st.ModTime().UTC().Format(http.TimeFormat))
-	hdrs.Set("Etag", fmt.Sprintf(`"%s"`, hex.EncodeToString(hash[:])))
-	hdrs.Set("Cache-Control", "max-age=604800, immutable, stale-if-error=604800")
-	return respond.WithHeaders(respond.Reader(fh), hdrs)
+	hdrs.Set("Etag", fmt.Sprintf(`"%s"`, hex.EncodeToString(key)))
+	if ns != nil {
+		hdrs.Set("Cache-Control", privateCacheControl)
+	} else {
+		hdrs.Set("Cache-Control", publicCacheControl)
+	}
+	body := countingReader{s.limiter.clientReader(fh), &s.metrics.bytesOut}
+	if s.conf.VerifyOnRead {
+		return s.verifiedResponse(body, hdrs, hs.algo, digest, true)
+	}
+	return respond.WithHeaders(respond.Reader(body), hdrs)
+}
+
+// sniffContentType guesses the content type of a blob from its first bytes.
+func sniffContentType(fh *os.File) string {
+	buf := make([]byte, 512)
+	n, _ := fh.ReadAt(buf, 0)
+	return http.DetectContentType(buf[:n])
+}
+
+// errNotInNamespace is returned by openBlob for blobs that exist, but not in
+// the requested namespace. We don't reveal whether other namespaces have it.
+var errNotInNamespace = fmt.Errorf("blob not in namespace: %w", os.ErrNotExist)
+
+// openBlob opens the blob with the given address and digest in hs if it's
+// visible in ns.
+func (s *server) openBlob(ns *namespace, hs *hashStore, key, digest []byte) (*os.File, error) {
+	if ns != nil {
+		has, err := ns.refs.Has(key)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			return nil, errNotInNamespace
+		}
+	}
+	return hs.store.Get(digest)
+}
+
+// Blobs never change, so they can be cached for long. Blobs in a namespace
+// mustn't be served from shared caches to clients of other namespaces.
+const (
+	publicCacheControl  = "max-age=604800, immutable, stale-if-error=604800"
+	privateCacheControl = "private, " + publicCacheControl
+)
+
+// forwardGetBlob tries to fetch a blob we don't have from the peers that
+// should have it, and returns nil if none of them does. The request was for
+// namespace ns, which may be nil.
+func (s *server) forwardGetBlob(ctx context.Context, ns *namespace, key []byte) convreq.HttpResponse {
+	resp := s.fetchFromPeers(ctx, key)
+	if resp == nil {
+		return nil
+	}
+	atomic.AddUint64(&s.metrics.downloads, 1)
+	hdrs := http.Header{}
+	for h, v := range resp.Header {
+		switch h {
+		case "Content-Length", "Last-Modified", "Etag", "Cache-Control", "Content-Type", "Content-Disposition", "X-Content-Type-Options":
+		default:
+			if !strings.HasPrefix(h, metaHeaderPrefix) {
+				continue
+			}
+		}
+		hdrs[h] = v
+	}
+	if ns != nil {
+		hdrs.Set("Cache-Control", privateCacheControl)
+	}
+	body := countingReader{s.limiter.clientReader(resp.Body), &s.metrics.bytesOut}
+	if s.conf.VerifyOnRead {
+		if hs, digest, err := s.lookup(key); err == nil {
+			return s.verifiedResponse(body, hdrs, hs.algo, digest, false)
+		}
+	}
+	return respond.WithHeaders(respond.Reader(body), hdrs)
+}
+
+// forwardTimeout is how long fetchFromPeers waits for a peer to start
+// answering if PeerTimeout isn't set.
+const forwardTimeout = 10 * time.Second
+
+// fetchFromPeers asks all the peers that should have a blob for it at once,
+// and returns the first response that serves it, or nil if none of them does.
+func (s *server) fetchFromPeers(ctx context.Context, key []byte) *http.Response {
+	ctx = withLogFields(ctx, "hash", hex.EncodeToString(key))
+	targets, err := s.peersFor(key)
+	if err != nil {
+		s.logger(ctx).Warn("getting peers to forward to failed", "err", err)
+		return nil
+	}
+	timeout := s.conf.PeerTimeout
+	if timeout <= 0 {
+		timeout = forwardTimeout
+	}
+	results := make(chan *http.Response, len(targets))
+	for _, t := range targets {
+		go func(t *url.URL) {
+			results <- s.fetchFromPeer(ctx, t, key, timeout)
+		}(t)
+	}
+	for i := range targets {
+		resp := <-results
+		if resp == nil {
+			continue
+		}
+		// Close the responses of slower peers as they come in.
+		go func(n int) {
+			for ; n > 0; n-- {
+				if resp := <-results; resp != nil {
+					resp.Body.Close()
+				}
+			}
+		}(len(targets) - i - 1)
+		return resp
+	}
+	return nil
+}
+
+// fetchFromPeer gets a blob from peer, and returns nil if peer doesn't start
+// serving it within timeout.
+func (s *server) fetchFromPeer(ctx context.Context, peer *url.URL, key []byte, timeout time.Duration) *http.Response {
+	ctx, cancel := s.peerContext(ctx)
+	timer := time.AfterFunc(timeout, cancel)
+	req, err := s.newPeerRequest(ctx, "GET", peerURL(peer, "/internal/blob/"+hex.EncodeToString(key)), nil)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		s.logger(ctx).Warn("forwarding failed", "peer", peer.String(), "err", err)
+		return nil
+	}
+	resp, err := s.client.Do(req)
+	if !timer.Stop() && err == nil {
+		// The deadline passed just after the response came in.
+		resp.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		s.logger(ctx).Warn("forwarding failed", "peer", peer.String(), "err", err)
+		return nil
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		cancel()
+		return nil
+	}
+	resp.Body = cancelingBody{resp.Body, cancel}
+	return resp
 }
 
 func (s *server) handleGetList(r *http.Request) convreq.HttpResponse {
@@ -118,21 +360,28 @@ func (s *server) handleGetList(r *http.Request) convreq.HttpResponse {
 		return respond.MethodNotAllowed("Method Not Allowed")
 	}
 
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	ns, resp := s.namespaceFor(r)
+	if resp != nil {
+		return resp
+	}
 
+	// Listing can take a long time, so it doesn't hold any lock. Blobs that
+	// are added or removed meanwhile may or may not be listed.
 	var ret []string
-	if err := s.store.Scan([]byte("1d"), 0, func(h []byte) {
-		ret = append(ret, hex.EncodeToString(h))
-	}); err != nil {
-		return respond.Error(err)
+	if ns != nil {
+		if err := ns.refs.Scan(r.Context(), nil, 0, func(key []byte) {
+			ret = append(ret, hex.EncodeToString(key))
+		}); err != nil {
+			return respond.Error(err)
+		}
+	} else {
+		for _, hs := range s.sortedHashStores() {
+			if err := hs.store.Scan(r.Context(), nil, 0, func(digest []byte) {
+				ret = append(ret, hex.EncodeToString(hs.algo.key(digest)))
+			}); err != nil {
+				return respond.Error(err)
+			}
+		}
 	}
 	return respond.String(fmt.Sprintf("%d entries\n", len(ret)) + strings.Join(ret, "\n"))
 }
-
-func warnOnErr(err error, message string, v ...interface{}) {
-	if err == nil {
-		return
-	}
-	log.Printf("warning: %s: %v", fmt.Sprintf(message, v...), err)
-}
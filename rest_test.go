@@ -4,7 +4,7 @@ import (
 	"fmt"
 )
 
-func ExampleHashPrefixToNumber() {
+func ExampleHash_PrefixToNumber() {
 	var h Hash
 	fmt.Println(h.PrefixToNumber(0))
 	fmt.Println(h.PrefixToNumber(2))
@@ -0,0 +1,251 @@
+package streisand
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+)
+
+// ScrubConfig configures the scrubber, which periodically rereads all blobs
+// to detect corruption. Corrupt blobs are quarantined and fetched again from
+// a peer.
+type ScrubConfig struct {
+	// Interval is the time between the starts of two passes over the
+	// store, and defaults to a day.
+	Interval time.Duration
+	// BytesPerSecond limits how fast blobs are read, and defaults to
+	// 10 MiB/s.
+	BytesPerSecond int64
+}
+
+// maxScrubFindings is the number of corrupt blobs remembered for /admin/scrub.
+const maxScrubFindings = 100
+
+type scrubber struct {
+	interval time.Duration
+	rate     *rateLimiter
+
+	mutex  sync.Mutex
+	status scrubStatus
+}
+
+type scrubStatus struct {
+	Running  bool       `json:"running"`
+	Passes   int        `json:"passes"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Total, Scanned and Bytes describe the current or last pass.
+	Total    int            `json:"total"`
+	Scanned  int            `json:"scanned"`
+	Bytes    int64          `json:"bytes"`
+	Corrupt  int            `json:"corrupt"`
+	Repaired int            `json:"repaired"`
+	Findings []scrubFinding `json:"findings,omitempty"`
+}
+
+type scrubFinding struct {
+	Hash     string    `json:"hash"`
+	Found    time.Time `json:"found"`
+	Repaired bool      `json:"repaired"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func newScrubber(conf ScrubConfig) *scrubber {
+	if conf.Interval <= 0 {
+		conf.Interval = 24 * time.Hour
+	}
+	if conf.BytesPerSecond <= 0 {
+		conf.BytesPerSecond = 10 << 20
+	}
+	return &scrubber{
+		interval: conf.Interval,
+		rate:     newRateLimiter(conf.BytesPerSecond),
+	}
+}
+
+func (sc *scrubber) update(f func(st *scrubStatus)) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	f(&sc.status)
+}
+
+func (sc *scrubber) addFinding(f scrubFinding) {
+	sc.update(func(st *scrubStatus) {
+		st.Corrupt++
+		if f.Repaired {
+			st.Repaired++
+		}
+		st.Findings = append(st.Findings, f)
+		if len(st.Findings) > maxScrubFindings {
+			st.Findings = st.Findings[len(st.Findings)-maxScrubFindings:]
+		}
+	})
+}
+
+func (s *server) scrubLoop() {
+	defer s.background.Done()
+	ctx, cancel := s.stopContext(context.Background())
+	defer cancel()
+
+	t := time.NewTimer(0)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+		}
+		t.Reset(s.scrubber.interval)
+		if err := s.scrubPass(ctx); err != nil && ctx.Err() == nil {
+			s.log.Error("scrubbing failed", "err", err)
+		}
+	}
+}
+
+// scrubPass verifies every blob in the store once.
+func (s *server) scrubPass(ctx context.Context) error {
+	var hashes [][]byte
+	for _, hs := range s.sortedHashStores() {
+		if err := hs.store.Scan(ctx, nil, 0, func(digest []byte) {
+			hashes = append(hashes, hs.algo.key(append([]byte(nil), digest...)))
+		}); err != nil {
+			return err
+		}
+	}
+	sc := s.scrubber
+	sc.update(func(st *scrubStatus) {
+		now := time.Now()
+		st.Running = true
+		st.Started = &now
+		st.Total = len(hashes)
+		st.Scanned = 0
+		st.Bytes = 0
+	})
+	defer sc.update(func(st *scrubStatus) {
+		now := time.Now()
+		st.Running = false
+		st.Finished = &now
+		st.Passes++
+	})
+
+	for _, hash := range hashes {
+		ok, n, err := s.verifyBlob(ctx, hash)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		sc.update(func(st *scrubStatus) {
+			st.Scanned++
+			st.Bytes += n
+		})
+		if ok {
+			continue
+		}
+		f := scrubFinding{Hash: hex.EncodeToString(hash), Found: time.Now()}
+		if err := s.quarantineBlob(ctx, hash); err != nil {
+			return err
+		}
+		if err := s.repairBlob(ctx, hash); err != nil {
+			f.Error = err.Error()
+		} else {
+			f.Repaired = true
+		}
+		sc.addFinding(f)
+	}
+	return nil
+}
+
+// verifyBlob rereads a blob at the scrubber's pace and returns whether its
+// contents still match its hash, and its size.
+func (s *server) verifyBlob(ctx context.Context, hash []byte) (bool, int64, error) {
+	hs, digest, err := s.lookup(hash)
+	if err != nil {
+		return false, 0, err
+	}
+	fh, err := hs.store.Get(digest)
+	if err != nil {
+		return false, 0, err
+	}
+	defer fh.Close()
+	h := hs.algo.New()
+	n, err := io.Copy(h, throttledReader{fh, ctx, []*rateLimiter{s.scrubber.rate}})
+	if err != nil {
+		return false, n, err
+	}
+	return bytes.Equal(h.Sum(nil), digest), n, nil
+}
+
+// quarantineBlob moves a corrupt blob out of the store and removes it from
+// the xor tree.
+func (s *server) quarantineBlob(ctx context.Context, hash []byte) error {
+	hs, digest, err := s.lookup(hash)
+	if err != nil {
+		return err
+	}
+	defer s.lockBlob(hs, digest)()
+	done, err := hs.xors.Prepare(xorHash(digest))
+	if err != nil {
+		return err
+	}
+	defer done()
+	size, err := hs.store.Quarantine(digest)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Adding a hash to the xor tree again removes it.
+	hs.xors.Add(xorHash(digest))
+	atomic.AddInt64(&s.metrics.blobs, -1)
+	atomic.AddInt64(&s.metrics.storeBytes, -size)
+	atomic.AddUint64(&s.metrics.corruptBlobs, 1)
+	s.logger(ctx).Error("quarantined corrupt blob", "hash", hex.EncodeToString(hash))
+	return nil
+}
+
+// repairBlob fetches a blob from the peers that should have it, until one of
+// them returns a good copy.
+func (s *server) repairBlob(ctx context.Context, hash []byte) error {
+	targets, err := s.peersFor(hash)
+	if err != nil {
+		return err
+	}
+	err = errors.New("no peers to repair from")
+	for _, t := range targets {
+		if err = s.pullBlob(ctx, t, hash); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// handleScrub shows the progress and findings of the scrubber.
+func (s *server) handleScrub(r *http.Request) convreq.HttpResponse {
+	if r.Method != "GET" {
+		return respond.MethodNotAllowed("Method Not Allowed")
+	}
+	if s.scrubber == nil {
+		return respond.NotFound("scrubbing is not enabled")
+	}
+	s.scrubber.mutex.Lock()
+	b, err := json.MarshalIndent(s.scrubber.status, "", "\t")
+	s.scrubber.mutex.Unlock()
+	if err != nil {
+		return respond.Error(err)
+	}
+	return respond.WithHeader(respond.Bytes(b), "Content-Type", "application/json")
+}
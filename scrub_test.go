@@ -0,0 +1,93 @@
+package streisand
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bertha/streisand/diskstore"
+)
+
+func TestScrub(t *testing.T) {
+	peer := newTestServer(t)
+	hs := httptest.NewServer(peer)
+	defer hs.Close()
+
+	srv, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		GetPeers: func() ([]*url.URL, error) {
+			return mustParseURLs(t, hs.URL), nil
+		},
+		Scrub: &ScrubConfig{Interval: time.Hour, BytesPerSecond: 1 << 30},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	s := srv.(*server)
+
+	status := func() scrubStatus {
+		s.scrubber.mutex.Lock()
+		defer s.scrubber.mutex.Unlock()
+		return s.scrubber.status
+	}
+	// Wait for the pass at startup, so the rest of the test doesn't race with it.
+	for status().Passes == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	good := upload(t, s, "good")
+	bad := upload(t, s, "bad")
+	upload(t, peer, "bad")
+	hash, err := hex.DecodeString(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := s.xors.GetLeaf((*Hash)(hash))
+	path := s.store.FullPath(hash)
+	if err := os.Chmod(path, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("rot"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.scrubPass(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	st := status()
+	if st.Total != 2 || st.Corrupt != 1 || st.Repaired != 1 || len(st.Findings) != 1 || st.Findings[0].Hash != bad {
+		t.Errorf("status after scrubbing: %+v", st)
+	}
+	for data, h := range map[string]string{"good": good, "bad": bad} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+h, nil))
+		if w.Code != 200 || w.Body.String() != data {
+			t.Errorf("GET %s after scrubbing: %d %q", data, w.Code, w.Body)
+		}
+	}
+	if after := s.xors.GetLeaf((*Hash)(hash)); after != before {
+		t.Errorf("xor leaf changed after repair: %s != %s", after.String(), before.String())
+	}
+	quarantined, err := os.ReadDir(filepath.Join(s.conf.DataDir, diskstore.QuarantineDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 1 {
+		t.Errorf("quarantined %d files, want 1", len(quarantined))
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/admin/scrub", nil))
+	if w.Code != 200 {
+		t.Errorf("GET /admin/scrub returned %d", w.Code)
+	}
+}
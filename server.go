@@ -1,10 +1,17 @@
 package streisand
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Jille/convreq"
 	"github.com/Jille/errchain"
@@ -14,6 +21,7 @@ import (
 type Server interface {
 	http.Handler
 	io.Closer
+	Store
 }
 
 type PeersFunc func() ([]*url.URL, error)
@@ -23,31 +31,234 @@ type ServerConfig struct {
 	WithFsync         bool
 	Debug             bool
 	GetPeers          PeersFunc
+
+	// HashAlgorithms are the hash algorithms that clients may choose for
+	// their uploads besides SHA256, which is always enabled and the
+	// default. Every algorithm has its own store in a subdirectory of
+	// DataDir and CacheDir.
+	HashAlgorithms []*HashAlgorithm
+
+	// LayerCount and LayerDepth shape the xor trees, which have LayerCount
+	// layers that each add LayerDepth bits of prefix. They default to 6
+	// and 4, which makes for a leaf layer of 2^24 entries of 32 bytes
+	// each; small nodes may want a shallower tree. Changing them rebuilds
+	// the trees on the next start.
+	LayerCount, LayerDepth int
+	// SparseXors keeps the xor trees in memory, storing only the entries
+	// of prefixes that have blobs, so that they take space in proportion
+	// to the number of blobs rather than to the depth. It suits small
+	// nodes and tests; switching it rebuilds the trees on the next start.
+	SparseXors bool
+	// BitsPerFolder is the number of bits of the hash that each level of
+	// directories in the stores takes, in multiples of 4. It defaults to
+	// 8, 8. Changing it moves all blobs on the next start.
+	BitsPerFolder []uint8
+
+	// Namespaces enables namespaces if not nil. Clients must then name a
+	// namespace in the X-StreiSANd-Namespace header, and can only see
+	// blobs uploaded to that namespace.
+	Namespaces map[string]NamespaceConfig
+
+	// Self is the URL under which the peers know this server. It's used to
+	// recognize ourselves in the list returned by GetPeers, and is required
+	// for write concerns of more than the local copy.
+	Self *url.URL
+	// Gossip, if not nil, enables gossip based membership. GetPeers then
+	// defaults to the live members, including Self, which is required.
+	Gossip *GossipConfig
+	// Placement, if not nil, stores each blob on only some of the nodes.
+	// Requests for blobs we don't have are forwarded to the nodes that
+	// should have them. It requires Self, and GetPeers must return all
+	// nodes including ourselves.
+	Placement *Placement
+
+	// MinFreeBytes is the amount of free disk space below which /readyz
+	// reports this server as not ready. Zero disables the check.
+	MinFreeBytes uint64
+
+	// ClientAuth guards the public endpoints, and PeerAuth guards the
+	// /internal/, /admin/ and /debug/ endpoints. A nil Authenticator
+	// allows everyone. /healthz, /readyz and /metrics are always open.
+	ClientAuth, PeerAuth Authenticator
+	// PeerCredentials is applied to every request we send to a peer, and
+	// should produce credentials that the peers' PeerAuth accepts.
+	PeerCredentials RequestSigner
+	// HTTPClient is used for all requests to peers. If nil, a client from
+	// NewPeerClient(nil) is used. Use TLSFiles.ClientConfig to configure
+	// custom CAs and client certificates.
+	HTTPClient *http.Client
+	// PeerTimeout, if not zero, is the deadline of every request to a
+	// peer, including the transfer of the blob, so it must leave room for
+	// the largest blobs at the replication bandwidth.
+	PeerTimeout time.Duration
+
+	// ReplicationLimits limit the bandwidth and concurrency of transfers
+	// between peers. Client traffic counts against the bandwidth limits too,
+	// but is never slowed down.
+	ReplicationLimits ReplicationLimits
+
+	// Scrub, if not nil, enables the scrubber, which periodically rereads
+	// all blobs and replaces corrupt ones with a copy from a peer.
+	Scrub *ScrubConfig
+	// VerifyOnRead checks blobs against their hash while serving them.
+	// Corrupt blobs are cut off before the client got all of it, and are
+	// quarantined and fetched again from a peer.
+	VerifyOnRead bool
+
+	// StartupCheck selects how the xor trees are verified against the
+	// stores when the server wasn't closed cleanly last time.
+	StartupCheck StartupCheck
+
+	// Logger receives all log messages. If nil, messages are written
+	// through the standard log package, including debug messages only
+	// if Debug is set.
+	Logger Logger
 }
 
 func NewServer(conf ServerConfig) (Server, error) {
+	if conf.Logger == nil {
+		conf.Logger = NewStdLogger(nil, conf.Debug)
+	}
+	if conf.HTTPClient == nil {
+		conf.HTTPClient = NewPeerClient(nil)
+	}
+	if conf.LayerCount == 0 {
+		conf.LayerCount = 6
+	}
+	if conf.LayerDepth == 0 {
+		conf.LayerDepth = 4
+	}
+	if conf.LayerCount < 0 || conf.LayerDepth < 0 || conf.LayerCount*conf.LayerDepth > 32 {
+		return nil, fmt.Errorf("invalid xor tree geometry: %d layers of depth %d", conf.LayerCount, conf.LayerDepth)
+	}
+	if conf.BitsPerFolder == nil {
+		conf.BitsPerFolder = append([]uint8(nil), diskstore.LegacyBitsPerFolder...)
+	}
+	var folderBits int
+	for _, n := range conf.BitsPerFolder {
+		if n == 0 || n%4 != 0 {
+			return nil, fmt.Errorf("invalid BitsPerFolder %v: not a multiple of 4", conf.BitsPerFolder)
+		}
+		folderBits += int(n)
+	}
+	if folderBits > 8*SHA256.Size {
+		return nil, fmt.Errorf("invalid BitsPerFolder %v: more bits than a hash has", conf.BitsPerFolder)
+	}
+	if conf.Placement != nil && conf.Self == nil {
+		return nil, errors.New("Placement requires Self")
+	}
+	if p := conf.Placement; p != nil {
+		if p.Replicas < 1 {
+			return nil, fmt.Errorf("invalid Placement: %d replicas", p.Replicas)
+		}
+		// Nodes reconcile the prefixes they share by their xor subtrees,
+		// so prefixes can't be longer than the tree is deep.
+		if p.prefixBits() > uint(conf.LayerCount*conf.LayerDepth) {
+			return nil, fmt.Errorf("invalid Placement: %d prefix bits for an xor tree of depth %d", p.prefixBits(), conf.LayerCount*conf.LayerDepth)
+		}
+	}
+	if !conf.StartupCheck.valid() {
+		return nil, fmt.Errorf("unknown startup check %q", conf.StartupCheck)
+	}
 	s := server{
-		conf: conf,
-		store: &diskstore.Store{
-			Path:          conf.DataDir,
-			BitsPerFolder: []uint8{8, 8},
-			Fsync:         conf.WithFsync,
-		},
-		xors: &XorStore{
-			LayerCount: 6,
-			LayerDepth: 4,
-			Path:       conf.CacheDir,
-		},
-		hmux: http.NewServeMux(),
-	}
-
-	s.store.Initialize()
-
-	if err := s.xors.Initialize(); err != nil {
+		conf:       conf,
+		hashStores: map[uint64]*hashStore{},
+		hmux:       http.NewServeMux(),
+		metrics:    &metrics{},
+		log:        conf.Logger,
+		client:     conf.HTTPClient,
+		limiter:    newLimiter(conf.ReplicationLimits),
+		stop:       make(chan struct{}),
+
+		outboxKick: make(chan struct{}, 1),
+	}
+	s.handler = s.logRequests(s.authenticate(s.hmux))
+
+	// The xor stores hold mmaps and log files, which have to be closed if
+	// anything after opening them fails.
+	var opened []*XorStore
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			for _, x := range opened {
+				x.Close()
+			}
+		}
+	}()
+
+	for _, algo := range append([]*HashAlgorithm{SHA256}, conf.HashAlgorithms...) {
+		if _, ok := s.hashStores[algo.Code]; ok {
+			continue
+		}
+		hs := s.newHashStore(algo)
+		if algo != SHA256 {
+			for _, dir := range []string{hs.store.Path, hs.xors.Path} {
+				if err := os.MkdirAll(dir, 0777); err != nil {
+					return nil, err
+				}
+			}
+		}
+		hs.store.Initialize()
+		if n, err := hs.store.Migrate(); err != nil {
+			return nil, fmt.Errorf("%s: moving blobs to new folders: %w", algo.Name, err)
+		} else if n > 0 {
+			s.log.Info("moved blobs to new folders", "algorithm", algo.Name, "blobs", n, "bits_per_folder", fmt.Sprint(conf.BitsPerFolder))
+		}
+		if err := hs.xors.Initialize(); err != nil {
+			return nil, fmt.Errorf("%s: %w", algo.Name, err)
+		}
+		opened = append(opened, hs.xors)
+		if n, err := hs.xors.Recover(hs.leaf(context.Background())); err != nil {
+			return nil, fmt.Errorf("%s: recovering xor store: %w", algo.Name, err)
+		} else if n > 0 {
+			s.log.Warn("repaired xor leaves after unclean shutdown", "algorithm", algo.Name, "leaves", n)
+			atomic.AddUint64(&s.metrics.xorRepairs, uint64(n))
+		}
+		s.hashStores[algo.Code] = hs
+	}
+	s.store = s.hashStores[SHA256.Code].store
+	s.xors = s.hashStores[SHA256.Code].xors
+
+	if err := s.checkStores(); err != nil {
+		return nil, err
+	}
+
+	if err := s.initNamespaces(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if s.outbox, err = openOutbox(filepath.Join(conf.CacheDir, "outbox"), conf.WithFsync); err != nil {
 		return nil, err
 	}
 
+	if conf.Gossip != nil {
+		if s.gossip, err = newGossip(*conf.Gossip, conf.Self); err != nil {
+			return nil, err
+		}
+		if s.conf.GetPeers == nil {
+			s.conf.GetPeers = s.gossip.peers
+		}
+		s.background.Add(1)
+		go s.gossipLoop()
+	}
+
+	s.background.Add(1)
+	go s.countStore()
+
+	s.background.Add(1)
+	go s.outboxLoop()
+
+	if conf.Scrub != nil {
+		s.scrubber = newScrubber(*conf.Scrub)
+		s.background.Add(1)
+		go s.scrubLoop()
+	}
+
 	s.hmux.HandleFunc("/blob/", convreq.Wrap(func(r *http.Request) convreq.HttpResponse {
+		if r.Method == "PUT" {
+			return s.handlePutBlob(r)
+		}
 		return s.handleGetBlob(r, true)
 	}))
 	s.hmux.HandleFunc("/internal/blob/", convreq.Wrap(func(r *http.Request) convreq.HttpResponse {
@@ -55,7 +266,18 @@ func NewServer(conf ServerConfig) (Server, error) {
 	}))
 	s.hmux.HandleFunc("/upload", convreq.Wrap(s.handlePostBlob))
 	s.hmux.HandleFunc("/internal/upload", convreq.Wrap(s.handleInternalPostBlob))
+	s.hmux.HandleFunc("/internal/gossip", convreq.Wrap(s.handleGossip))
+	s.hmux.HandleFunc("/internal/xors", convreq.Wrap(s.handleInternalXors))
 	s.hmux.HandleFunc("/list", convreq.Wrap(s.handleGetList))
+	s.hmux.HandleFunc("/admin/export", convreq.Wrap(s.handleExport))
+	s.hmux.HandleFunc("/admin/import", convreq.Wrap(s.handleImport))
+	s.hmux.HandleFunc("/admin/outbox", convreq.Wrap(s.handleOutbox))
+	s.hmux.HandleFunc("/admin/scrub", convreq.Wrap(s.handleScrub))
+	s.hmux.HandleFunc("/admin/diff", convreq.Wrap(s.handleDiff))
+	s.hmux.HandleFunc("/metrics", s.handleMetrics)
+	s.hmux.HandleFunc("/healthz", convreq.Wrap(s.handleHealthz))
+	s.hmux.HandleFunc("/readyz", convreq.Wrap(s.handleReadyz))
+	s.hmux.HandleFunc("/status", convreq.Wrap(s.handleStatus))
 	s.hmux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
 	})
 
@@ -64,27 +286,82 @@ func NewServer(conf ServerConfig) (Server, error) {
 			convreq.Wrap(s.handleDebugAddXor))
 	}
 
+	succeeded = true
 	return &s, nil
 }
 
 type server struct {
 	conf ServerConfig
 
-	store *diskstore.Store
-	xors  *XorStore
-	mutex sync.RWMutex
-	hmux  *http.ServeMux
+	// hashStores holds the stores of all enabled hash algorithms by their
+	// multihash code. store and xors are the SHA-256 ones.
+	hashStores map[uint64]*hashStore
+	store      *diskstore.Store
+	xors       *XorStore
+
+	// mutex is held for reading by everything that uses the stores, and
+	// for writing by Close. See blobLockStripes.
+	mutex     sync.RWMutex
+	blobLocks [blobLockStripes]sync.Mutex
+	hmux      *http.ServeMux
+	handler   http.Handler
+	metrics   *metrics
+	log       Logger
+	client    *http.Client
+	limiter   *limiter
+	peers     peerTracker
+
+	namespaces map[string]*namespace
+	gossip     *gossip
+	outbox     *outbox
+	outboxKick chan struct{}
+	scrubber   *scrubber
+
+	// stop is closed by Close to stop the background goroutines, which
+	// are tracked by background. stopMutex is held while closing it, so
+	// that goroutines started later can't be missed by Close.
+	stop       chan struct{}
+	stopOnce   sync.Once
+	stopMutex  sync.Mutex
+	background sync.WaitGroup
+}
+
+// startBackground registers a goroutine that's started after NewServer
+// with background, unless the server is being closed. It returns whether
+// the goroutine may start.
+func (s *server) startBackground() bool {
+	s.stopMutex.Lock()
+	defer s.stopMutex.Unlock()
+	select {
+	case <-s.stop:
+		return false
+	default:
+	}
+	s.background.Add(1)
+	return true
 }
 
 func (s *server) Close() (err error) {
+	s.stopOnce.Do(func() {
+		s.stopMutex.Lock()
+		close(s.stop)
+		s.stopMutex.Unlock()
+	})
+	s.background.Wait()
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	errchain.Call(&err, s.xors.Close)
+	for _, hs := range s.hashStores {
+		errchain.Call(&err, hs.xors.Close)
+	}
+	if err == nil {
+		err = s.markCleanShutdown()
+	}
 
 	return err
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.hmux.ServeHTTP(w, r)
+	s.handler.ServeHTTP(w, r)
 }
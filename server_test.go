@@ -2,9 +2,15 @@ package streisand
 
 import (
 	"bytes"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -66,4 +72,190 @@ func TestServer(t *testing.T) {
 	}
 }
 
-// TODO: add benchmarks for simultaneous up-/downloading
+func TestConcurrentUploads(t *testing.T) {
+	s := newTestServer(t)
+
+	var (
+		wg     sync.WaitGroup
+		mutex  sync.Mutex
+		hashes []string
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				h, err := tryUpload(s, fmt.Sprintf("blob %d-%d", i, j))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mutex.Lock()
+				hashes = append(hashes, h)
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every leaf must be the xor of the blobs in it, and the top layer
+	// the xor of all blobs.
+	xors := s.(*server).xors
+	leaves := map[uint32]Hash{}
+	var all, root Hash
+	for _, h := range hashes {
+		digest, err := hex.DecodeString(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x := xorHash(digest)
+		leaf := leaves[x.PrefixToNumber(uint(xors.Depth()))]
+		x.XorInto(leaf[:])
+		leaves[x.PrefixToNumber(uint(xors.Depth()))] = leaf
+		x.XorInto(all[:])
+	}
+	for _, h := range hashes {
+		digest, _ := hex.DecodeString(h)
+		x := xorHash(digest)
+		got, want := xors.GetLeaf(x), leaves[x.PrefixToNumber(uint(xors.Depth()))]
+		if !got.Equals(&want) {
+			t.Errorf("leaf of %s is %s, want %s", h, got.String(), want.String())
+		}
+	}
+	top := xors.layers[0]
+	for i := 0; i < 1<<top.PrefixLength; i++ {
+		var p Hash
+		p[0] = byte(i << (8 - top.PrefixLength))
+		e := top.Get(&p)
+		e.XorInto(root[:])
+	}
+	if !root.Equals(&all) {
+		t.Errorf("xor of all blobs is %s, want %s", root.String(), all.String())
+	}
+}
+
+// benchmarkBlob returns unique contents for a blob in a benchmark.
+func benchmarkBlob(n *uint64) string {
+	return fmt.Sprintf("benchmark blob %d", atomic.AddUint64(n, 1))
+}
+
+func BenchmarkUpload(b *testing.B) {
+	s := newTestServer(b)
+	var n uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := tryUpload(s, benchmarkBlob(&n)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkDownload(b *testing.B) {
+	s := newTestServer(b)
+	var n uint64
+	hashes := make([]string, 100)
+	for i := range hashes {
+		hashes[i] = upload(b, s, benchmarkBlob(&n))
+	}
+	var i uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h := hashes[atomic.AddUint64(&i, 1)%uint64(len(hashes))]
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+h, nil))
+			if w.Code != 200 {
+				b.Errorf("download: %d", w.Code)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkUploadAndDownload(b *testing.B) {
+	s := newTestServer(b)
+	var n uint64
+	first := upload(b, s, benchmarkBlob(&n))
+	var i uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if atomic.AddUint64(&i, 1)%2 == 0 {
+				if _, err := tryUpload(s, benchmarkBlob(&n)); err != nil {
+					b.Error(err)
+					return
+				}
+				continue
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+first, nil))
+			if w.Code != 200 {
+				b.Errorf("download: %d", w.Code)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkUploadDuringList measures uploads while /list runs continuously.
+func BenchmarkUploadDuringList(b *testing.B) {
+	s := newTestServer(b)
+	var n uint64
+	for i := 0; i < 1000; i++ {
+		upload(b, s, benchmarkBlob(&n))
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/list", nil))
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := tryUpload(s, benchmarkBlob(&n)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func TestNewServerFailureClosesXors(t *testing.T) {
+	openFiles := func() int {
+		des, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip(err)
+		}
+		return len(des)
+	}
+	cacheDir := t.TempDir()
+	// The outbox is opened after the xor stores, and can't be now.
+	if err := os.WriteFile(filepath.Join(cacheDir, "outbox"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	before := openFiles()
+	if _, err := NewServer(ServerConfig{
+		DataDir:        t.TempDir(),
+		CacheDir:       cacheDir,
+		HashAlgorithms: []*HashAlgorithm{SHA256, BLAKE3},
+	}); err == nil {
+		t.Fatal("NewServer succeeded without an outbox")
+	}
+	if after := openFiles(); after != before {
+		t.Errorf("%d files open after failed NewServer, want %d", after, before)
+	}
+}
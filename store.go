@@ -0,0 +1,123 @@
+package streisand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+)
+
+// Store is the API of a Server for applications that embed it, without going
+// through HTTP. It works on the SHA-256 store, whose blobs are addressed by
+// their digest, and ignores namespaces. Blobs that are put are replicated to
+// the peers like uploads are.
+type Store interface {
+	// Put stores the blob read from r and returns its hash. It fails if
+	// namespaces are enabled, because the blob wouldn't belong to any.
+	Put(ctx context.Context, r io.Reader) (Hash, error)
+	// Get opens a blob. If we don't have it, it's fetched from the peers
+	// that should. The error wraps os.ErrNotExist if none of them has it.
+	// Reading a fetched blob fails at the end if it doesn't match h, and so
+	// does reading a local one if VerifyOnRead is set, which quarantines
+	// and repairs it too.
+	Get(ctx context.Context, h Hash) (io.ReadCloser, error)
+	// Has returns whether we store a blob.
+	Has(h Hash) (bool, error)
+	// List returns the hashes of the blobs we store that start with
+	// prefix, in no particular order.
+	List(prefix Prefix) ([]Hash, error)
+	Stats() Stats
+}
+
+// Stats are some of the counters that are exported on /metrics.
+type Stats struct {
+	// Blobs and Bytes are the number and total size of the blobs in all
+	// hash stores. They're counted in the background after starting and
+	// daily, so blobs that are added or removed during a count can be off
+	// until the next one.
+	Blobs, Bytes int64
+	// Uploads and Downloads count the blobs that were put and gotten,
+	// over HTTP or through Store.
+	Uploads, Downloads uint64
+	// BytesIn and BytesOut count the bytes of the blobs that were
+	// received and sent, from and to both clients and peers.
+	BytesIn, BytesOut uint64
+	// Queued is the number of blobs that still have to be pushed to a
+	// peer, counting a blob once for every peer.
+	Queued int
+}
+
+var errNamespacesEnabled = errors.New("Store.Put can't be used when namespaces are enabled")
+
+func (s *server) Put(ctx context.Context, r io.Reader) (Hash, error) {
+	var h Hash
+	if s.namespaces != nil {
+		return h, errNamespacesEnabled
+	}
+	hash, isNew, err := s.post(ctx, s.hashStores[SHA256.Code], ioutil.NopCloser(r), nil)
+	if err != nil {
+		return h, err
+	}
+	copy(h[:], hash)
+	if isNew {
+		s.enqueueForPeers(ctx, hash, "")
+	}
+	atomic.AddUint64(&s.metrics.uploads, 1)
+	return h, nil
+}
+
+func (s *server) Get(ctx context.Context, h Hash) (io.ReadCloser, error) {
+	fh, err := s.store.Get(h[:])
+	if err == nil {
+		atomic.AddUint64(&s.metrics.downloads, 1)
+		var body io.ReadCloser = fh
+		if s.conf.VerifyOnRead {
+			body = &verifyingReader{ReadCloser: fh, h: SHA256.New(), digest: h[:], corrupt: func() {
+				s.repairCorrupt(ctx, h[:])
+			}}
+		}
+		return countingReader{body, &s.metrics.bytesOut}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if resp := s.fetchFromPeers(ctx, h[:]); resp != nil {
+		atomic.AddUint64(&s.metrics.downloads, 1)
+		body := &verifyingReader{ReadCloser: resp.Body, h: SHA256.New(), digest: h[:]}
+		return countingReader{body, &s.metrics.bytesOut}, nil
+	}
+	atomic.AddUint64(&s.metrics.notFound, 1)
+	return nil, fmt.Errorf("blob %s: %w", h.String(), os.ErrNotExist)
+}
+
+func (s *server) Has(h Hash) (bool, error) {
+	return s.store.Has(h[:])
+}
+
+func (s *server) List(prefix Prefix) ([]Hash, error) {
+	if prefix.Length < 0 || prefix.Length > 255 {
+		return nil, fmt.Errorf("invalid prefix length %d", prefix.Length)
+	}
+	var ret []Hash
+	err := s.store.Scan(context.Background(), prefix.Hash[:], uint8(prefix.Length), func(digest []byte) {
+		var h Hash
+		copy(h[:], digest)
+		ret = append(ret, h)
+	})
+	return ret, err
+}
+
+func (s *server) Stats() Stats {
+	return Stats{
+		Blobs:     atomic.LoadInt64(&s.metrics.blobs),
+		Bytes:     atomic.LoadInt64(&s.metrics.storeBytes),
+		Uploads:   atomic.LoadUint64(&s.metrics.uploads),
+		Downloads: atomic.LoadUint64(&s.metrics.downloads),
+		BytesIn:   atomic.LoadUint64(&s.metrics.bytesIn),
+		BytesOut:  atomic.LoadUint64(&s.metrics.bytesOut),
+		Queued:    s.outbox.total(),
+	}
+}
@@ -0,0 +1,104 @@
+package streisand
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	peer := newTestServer(t)
+	phs := httptest.NewServer(peer)
+	defer phs.Close()
+
+	s, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		GetPeers: func() ([]*url.URL, error) {
+			return mustParseURLs(t, phs.URL), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	h, err := s.Put(ctx, strings.NewReader("local"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := Hash(sha256.Sum256([]byte("local"))); h != want {
+		t.Errorf("Put returned %s, want %s", h.String(), want.String())
+	}
+	if has, err := s.Has(h); err != nil || !has {
+		t.Errorf("Has(%s) = %v, %v", h.String(), has, err)
+	}
+
+	// Blobs that we don't have are fetched from the peers.
+	remote, err := peer.Put(ctx, strings.NewReader("remote"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has, err := s.Has(remote); err != nil || has {
+		t.Errorf("Has(%s) = %v, %v", remote.String(), has, err)
+	}
+	for h, want := range map[Hash]string{h: "local", remote: "remote"} {
+		rc, err := s.Get(ctx, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(b) != want {
+			t.Errorf("Get(%s) = %q, %v; want %q", h.String(), b, err, want)
+		}
+	}
+	// A peer that serves a corrupt copy makes reading it fail.
+	corrupt(t, peer.(*server), remote.String())
+	rc, err := s.Get(ctx, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rc); !errors.Is(err, errHashMismatch) {
+		t.Errorf("reading a corrupt blob from a peer returned %v", err)
+	}
+	rc.Close()
+	if _, err := s.Get(ctx, Hash{1}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Get of a missing blob returned %v", err)
+	}
+
+	if hashes, err := s.List(Prefix{Hash: h, Length: 12}); err != nil || len(hashes) != 1 || hashes[0] != h {
+		t.Errorf("List of the prefix of %s returned %v, %v", h.String(), hashes, err)
+	}
+	other := h
+	other[0] ^= 0x80
+	if hashes, err := s.List(Prefix{Hash: other, Length: 1}); err != nil || len(hashes) != 0 {
+		t.Errorf("List of the other half returned %v, %v", hashes, err)
+	}
+
+	if st := s.Stats(); st.Uploads != 1 || st.Downloads != 3 {
+		t.Errorf("Stats() = %+v", st)
+	}
+}
+
+func TestStorePutNamespaces(t *testing.T) {
+	s, err := NewServer(ServerConfig{
+		DataDir:    t.TempDir(),
+		CacheDir:   t.TempDir(),
+		Namespaces: map[string]NamespaceConfig{"alice": {}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Put(context.Background(), strings.NewReader("blob")); err == nil {
+		t.Error("Put succeeded with namespaces enabled")
+	}
+}
@@ -1,63 +1,286 @@
+// Package streisandtest runs clusters of StreiSANd servers for tests. The
+// traffic between the servers can be partitioned, delayed and made to fail,
+// and servers can be killed and restarted, to test that they converge.
 package streisandtest
 
 import (
-	"github.com/Jille/errchain"
-	"github.com/bertha/streisand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jille/errchain"
+	"github.com/bertha/streisand"
 )
 
 type Server struct {
+	// Streisand is replaced by Restart, and nil while the server is
+	// killed.
 	Streisand         streisand.Server
 	Http              *httptest.Server
 	DataDir, CacheDir string
+	// URL is the URL under which the other servers know this one.
+	URL *url.URL
+
+	conf  streisand.ServerConfig
+	mutex sync.Mutex
 }
 
 type Servers struct {
 	Servers []*Server
+
+	mutex sync.Mutex
+	// partition holds the group of every server while the servers are
+	// partitioned.
+	partition []int
+	faults    map[link]Fault
 }
 
-func NewServer(getPeers streisand.PeersFunc,
-	tempDir func() string) (*Server, error) {
+// AnyNode matches every server in SetFault.
+const AnyNode = -1
 
-	var err error
-	conf := streisand.ServerConfig{
-		WithFsync: true,
-		Debug:     true,
-		GetPeers:  getPeers,
+type link struct {
+	from, to int
+}
+
+// Fault describes what happens to the requests that one server sends to
+// another.
+type Fault struct {
+	// Latency delays every request.
+	Latency time.Duration
+	// ErrorRate is the fraction of requests that fail without reaching
+	// the other server.
+	ErrorRate float64
+	// ErrorStatus is the HTTP status code of the failed requests. If it's
+	// zero, they fail with a connection error instead.
+	ErrorStatus int
+}
+
+// errInjected is returned for requests that fail because of a Fault or a
+// partition.
+var errInjected = errors.New("streisandtest: injected fault")
+
+// startServer starts serving s, while it's still killed.
+func startServer(tempDir func() string) (*Server, error) {
+	s := &Server{
+		DataDir:  tempDir(),
+		CacheDir: tempDir(),
 	}
+	s.Http = httptest.NewServer(s)
+	u, err := url.Parse(s.Http.URL)
+	if err != nil {
+		s.Http.Close()
+		return nil, err
+	}
+	s.URL = u
+	return s, nil
+}
 
-	conf.DataDir = tempDir()
-	conf.CacheDir = tempDir()
+func NewServer(getPeers streisand.PeersFunc,
+	tempDir func() string) (*Server, error) {
 
-	ss, err := streisand.NewServer(conf)
+	s, err := startServer(tempDir)
 	if err != nil {
 		return nil, err
 	}
-	s := &Server{
-		Streisand: ss,
-		Http:      httptest.NewServer(ss),
-		DataDir:   conf.DataDir,
-		CacheDir:  conf.CacheDir,
+	s.conf = streisand.ServerConfig{GetPeers: getPeers}
+	if err := s.Restart(); err != nil {
+		s.Http.Close()
+		return nil, err
 	}
 	return s, nil
 }
 
+// Restart starts a killed server again, with the same data and config.
+func (s *Server) Restart() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.Streisand != nil {
+		return errors.New("streisandtest: server is already running")
+	}
+	conf := s.conf
+	conf.WithFsync = true
+	conf.Debug = true
+	conf.Self = s.URL
+	conf.DataDir = s.DataDir
+	conf.CacheDir = s.CacheDir
+	ss, err := streisand.NewServer(conf)
+	if err != nil {
+		return err
+	}
+	s.Streisand = ss
+	return nil
+}
+
+// Kill closes the StreiSANd server. Until it's restarted, requests to it
+// fail as if nothing was listening.
+func (s *Server) Kill() error {
+	s.mutex.Lock()
+	ss := s.Streisand
+	s.Streisand = nil
+	s.mutex.Unlock()
+	if ss == nil {
+		return nil
+	}
+	return ss.Close()
+}
+
+// Up returns whether the server wasn't killed.
+func (s *Server) Up() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Streisand != nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	ss := s.Streisand
+	s.mutex.Unlock()
+	if ss == nil {
+		panic(http.ErrAbortHandler)
+	}
+	ss.ServeHTTP(w, r)
+}
+
 func (s *Server) Close() error {
 	var err error
 	s.Http.Close()
-	errchain.Append(&err, s.Streisand.Close())
+	errchain.Append(&err, s.Kill())
 	return err
 }
 
+// Upload uploads data and returns its hash.
+func (s *Server) Upload(data string) (string, error) {
+	resp, err := http.Post(s.Http.URL+"/upload", "application/octet-stream", strings.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("upload to %s: %s: %s", s.URL, resp.Status, b)
+	}
+	return string(b), nil
+}
+
+// Root returns the root of the server's SHA-256 xor tree.
+func (s *Server) Root() (streisand.Hash, error) {
+	var root streisand.Hash
+	b, err := s.get("/internal/xors?depth=0&start=0&count=1")
+	if err != nil {
+		return root, err
+	}
+	if len(b) != len(root) {
+		return root, fmt.Errorf("%s returned %d bytes of xors", s.URL, len(b))
+	}
+	copy(root[:], b)
+	return root, nil
+}
+
+// Blobs returns the sorted hashes of the blobs on the server.
+func (s *Server) Blobs() ([]string, error) {
+	b, err := s.get("/list")
+	if err != nil {
+		return nil, err
+	}
+	// The first line is the number of entries.
+	lines := strings.Split(string(b), "\n")[1:]
+	ret := lines[:0]
+	for _, l := range lines {
+		if l != "" {
+			ret = append(ret, l)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// pending returns the number of blobs queued for each peer.
+func (s *Server) pending() (map[string]int, error) {
+	b, err := s.get("/admin/outbox")
+	if err != nil {
+		return nil, err
+	}
+	var st []struct {
+		Peer    string `json:"peer"`
+		Pending int    `json:"pending"`
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	ret := map[string]int{}
+	for _, p := range st {
+		ret[p.Peer] = p.Pending
+	}
+	return ret, nil
+}
+
+// get fetches path from the server directly, without faults.
+func (s *Server) get(path string) ([]byte, error) {
+	resp, err := http.Get(s.Http.URL + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("GET %s%s: %s", s.URL, path, resp.Status)
+	}
+	return b, nil
+}
+
 func NewServers(serverCount uint, tempDir func() string) (*Servers, error) {
-	var err error
+	return NewServersWithConfig(serverCount, tempDir, nil)
+}
+
+// NewServersWithConfig is like NewServers, but passes the config of every
+// server through configure first. The servers' requests to each other go
+// through the faults set with Partition and SetFault.
+func NewServersWithConfig(serverCount uint, tempDir func() string,
+	configure func(conf *streisand.ServerConfig)) (*Servers, error) {
+
 	s := &Servers{
 		Servers: make([]*Server, serverCount),
+		faults:  map[link]Fault{},
 	}
-	for i := uint(0); i < serverCount; i++ {
-		s.Servers[i], err = NewServer(s.getPeers, tempDir)
+	// All servers listen before any of them starts, so that GetPeers
+	// always returns all of them.
+	for i := range s.Servers {
+		srv, err := startServer(tempDir)
 		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.Servers[i] = srv
+	}
+	for i, srv := range s.Servers {
+		srv.conf = streisand.ServerConfig{GetPeers: s.getPeers}
+		if configure != nil {
+			configure(&srv.conf)
+		}
+		var next http.RoundTripper = http.DefaultTransport
+		if srv.conf.HTTPClient != nil && srv.conf.HTTPClient.Transport != nil {
+			next = srv.conf.HTTPClient.Transport
+		}
+		srv.conf.HTTPClient = &http.Client{Transport: &faultTransport{s, i, next}}
+		if err := srv.Restart(); err != nil {
+			s.Close()
 			return nil, err
 		}
 	}
@@ -66,19 +289,224 @@ func NewServers(serverCount uint, tempDir func() string) (*Servers, error) {
 
 func (s *Servers) Close() (err error) {
 	for i := 0; i < len(s.Servers); i++ {
-		errchain.Append(&err, s.Servers[i].Close())
+		if s.Servers[i] != nil {
+			errchain.Append(&err, s.Servers[i].Close())
+		}
 	}
 	return
 }
 
 func (s *Servers) getPeers() ([]*url.URL, error) {
-	var err error
 	result := make([]*url.URL, len(s.Servers))
 	for i := 0; i < len(s.Servers); i++ {
-		result[i], err = url.Parse(s.Servers[i].Http.URL)
+		result[i] = s.Servers[i].URL
+	}
+	return result, nil
+}
+
+// Kill kills server i. See Server.Kill.
+func (s *Servers) Kill(i int) error {
+	return s.Servers[i].Kill()
+}
+
+// Restart restarts server i. See Server.Restart.
+func (s *Servers) Restart(i int) error {
+	return s.Servers[i].Restart()
+}
+
+// Partition splits the servers into groups that can't reach each other.
+// Servers that aren't in any group can't reach any other server.
+func (s *Servers) Partition(groups ...[]int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.partition = make([]int, len(s.Servers))
+	for i := range s.partition {
+		s.partition[i] = len(groups) + i
+	}
+	for g, group := range groups {
+		for _, i := range group {
+			s.partition[i] = g
+		}
+	}
+}
+
+// SetFault sets the fault for the requests from server from to server to.
+// Either may be AnyNode. A fault for a specific pair of servers takes
+// precedence over one for AnyNode.
+func (s *Servers) SetFault(from, to int, f Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults[link{from, to}] = f
+}
+
+// Heal removes all partitions and faults.
+func (s *Servers) Heal() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.partition = nil
+	s.faults = map[link]Fault{}
+}
+
+// fault returns whether from and to are partitioned, and the fault for the
+// requests between them.
+func (s *Servers) fault(from, to int) (bool, Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.partition != nil && s.partition[from] != s.partition[to] {
+		return true, Fault{}
+	}
+	for _, l := range []link{{from, to}, {from, AnyNode}, {AnyNode, to}, {AnyNode, AnyNode}} {
+		if f, ok := s.faults[l]; ok {
+			return false, f
+		}
+	}
+	return false, Fault{}
+}
+
+// faultTransport applies the partitions and faults to the requests of
+// server from.
+type faultTransport struct {
+	servers *Servers
+	from    int
+	next    http.RoundTripper
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	to := -1
+	for i, srv := range t.servers.Servers {
+		if srv.URL.Host == req.URL.Host {
+			to = i
+		}
+	}
+	if to < 0 {
+		return t.next.RoundTrip(req)
+	}
+	partitioned, f := t.servers.fault(t.from, to)
+	fail := func(err error) (*http.Response, error) {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	if partitioned {
+		return fail(errInjected)
+	}
+	if f.Latency > 0 {
+		tm := time.NewTimer(f.Latency)
+		select {
+		case <-tm.C:
+		case <-req.Context().Done():
+			tm.Stop()
+			return fail(req.Context().Err())
+		}
+	}
+	if f.ErrorRate > 0 && rand.Float64() < f.ErrorRate {
+		if f.ErrorStatus == 0 {
+			return fail(errInjected)
+		}
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", f.ErrorStatus, http.StatusText(f.ErrorStatus)),
+			StatusCode: f.ErrorStatus,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(errInjected.Error())),
+			Request:    req,
+		}, nil
+	}
+	return t.next.RoundTrip(req)
+}
+
+// up returns the servers that weren't killed.
+func (s *Servers) up() []*Server {
+	var ret []*Server
+	for _, srv := range s.Servers {
+		if srv.Up() {
+			ret = append(ret, srv)
+		}
+	}
+	return ret
+}
+
+// Converged returns nil if the servers that are up have pushed all blobs
+// queued for each other and have the same xor root. That only means they
+// store the same blobs if every blob belongs on every server.
+func (s *Servers) Converged() error {
+	up := s.up()
+	var first streisand.Hash
+	for n, srv := range up {
+		pending, err := srv.pending()
 		if err != nil {
-			return nil, err
+			return err
+		}
+		for _, peer := range up {
+			if p := pending[peer.URL.String()]; p > 0 {
+				return fmt.Errorf("%s has %d blobs queued for %s", srv.URL, p, peer.URL)
+			}
+		}
+		root, err := srv.Root()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			first = root
+		} else if root != first {
+			return fmt.Errorf("%s has xor root %s, but %s has %s", srv.URL, root.String(), up[0].URL, first.String())
+		}
+	}
+	return nil
+}
+
+// WaitForConvergence waits until Converged returns nil, and returns its last
+// error if that takes longer than timeout.
+func (s *Servers) WaitForConvergence(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := s.Converged()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not converged after %s: %w", timeout, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// AssertConverged fails the test unless the servers that are up have the
+// same xor root and the same blobs.
+func (s *Servers) AssertConverged(t testing.TB) {
+	t.Helper()
+	up := s.up()
+	if len(up) == 0 {
+		return
+	}
+	wantRoot, err := up[0].Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBlobs, err := up[0].Blobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, srv := range up[1:] {
+		root, err := srv.Root()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root != wantRoot {
+			t.Errorf("%s has xor root %s, but %s has %s", srv.URL, root.String(), up[0].URL, wantRoot.String())
+		}
+		blobs, err := srv.Blobs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(blobs, ",") != strings.Join(wantBlobs, ",") {
+			t.Errorf("%s has blobs %v, but %s has %v", srv.URL, blobs, up[0].URL, wantBlobs)
 		}
 	}
-	return result, nil
 }
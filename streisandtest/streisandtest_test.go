@@ -0,0 +1,135 @@
+package streisandtest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// convergeTimeout leaves room for a few retries of the outbox, which backs
+// off after failed pushes.
+const convergeTimeout = 30 * time.Second
+
+func newTestServers(t *testing.T, n uint) *Servers {
+	s, err := NewServers(n, t.TempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return s
+}
+
+func has(t *testing.T, srv *Server, hash string) bool {
+	t.Helper()
+	blobs, err := srv.Blobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blobs {
+		if b == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReplication(t *testing.T) {
+	s := newTestServers(t, 3)
+	for i, srv := range s.Servers {
+		if _, err := srv.Upload(fmt.Sprintf("blob %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.WaitForConvergence(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	s.AssertConverged(t)
+	if blobs, err := s.Servers[0].Blobs(); err != nil || len(blobs) != 3 {
+		t.Errorf("Blobs() = %v, %v; want 3 blobs", blobs, err)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	s := newTestServers(t, 3)
+	s.Partition([]int{0, 1}, []int{2})
+	a, err := s.Servers[0].Upload("majority")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Servers[2].Upload("minority")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WaitForConvergence(500 * time.Millisecond); err == nil {
+		t.Fatal("partitioned servers converged")
+	}
+	if !has(t, s.Servers[1], a) || has(t, s.Servers[2], a) || has(t, s.Servers[0], b) {
+		t.Error("blobs crossed the partition")
+	}
+
+	s.Heal()
+	if err := s.WaitForConvergence(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	s.AssertConverged(t)
+}
+
+func TestKillAndRestart(t *testing.T) {
+	s := newTestServers(t, 3)
+	if err := s.Kill(2); err != nil {
+		t.Fatal(err)
+	}
+	h, err := s.Servers[0].Upload("while 2 was down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The servers that are up converge without the killed one.
+	if err := s.WaitForConvergence(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Restart(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WaitForConvergence(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	s.AssertConverged(t)
+	if !has(t, s.Servers[2], h) {
+		t.Error("restarted server didn't get the blob")
+	}
+}
+
+func TestFaults(t *testing.T) {
+	s := newTestServers(t, 2)
+	s.SetFault(0, 1, Fault{ErrorRate: 1, ErrorStatus: 503})
+	s.SetFault(1, 0, Fault{ErrorRate: 1})
+	if _, err := s.Servers[0].Upload("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Servers[1].Upload("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WaitForConvergence(500 * time.Millisecond); err == nil {
+		t.Fatal("servers converged while all pushes failed")
+	}
+
+	s.Heal()
+	const latency = 100 * time.Millisecond
+	s.SetFault(AnyNode, AnyNode, Fault{Latency: latency})
+	start := time.Now()
+	if _, err := s.Servers[0].Upload("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WaitForConvergence(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < latency {
+		t.Errorf("converged after %s, despite a latency of %s", d, latency)
+	}
+	s.AssertConverged(t)
+}
@@ -0,0 +1,108 @@
+package streisand
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// TLSFiles names the PEM files used to secure traffic between peers. All of
+// them are optional.
+type TLSFiles struct {
+	// CAFile holds the certificates of the authorities that sign the
+	// certificates of peers. If empty, the system roots are used.
+	CAFile string
+	// CertFile and KeyFile hold this node's certificate and key, which it
+	// presents both as a server and as a client to its peers.
+	CertFile, KeyFile string
+}
+
+func (f TLSFiles) load() (*x509.CertPool, []tls.Certificate, error) {
+	var pool *x509.CertPool
+	if f.CAFile != "" {
+		pem, err := os.ReadFile(f.CAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", f.CAFile)
+		}
+	}
+	var certs []tls.Certificate
+	if f.CertFile != "" || f.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return pool, certs, nil
+}
+
+// ClientConfig returns a TLS config for connecting to peers, which trusts
+// CAFile and presents CertFile as client certificate.
+func (f TLSFiles) ClientConfig() (*tls.Config, error) {
+	pool, certs, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		RootCAs:      pool,
+		Certificates: certs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ServerConfig returns a TLS config for serving with CertFile. Client
+// certificates are verified against CAFile if they're given, so that
+// TLSClientNames can identify peers while clients don't need certificates.
+func (f TLSFiles) ServerConfig() (*tls.Config, error) {
+	pool, certs, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("serving TLS requires a certificate and key")
+	}
+	conf := &tls.Config{
+		Certificates: certs,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if pool != nil {
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf, nil
+}
+
+// NewPeerClient returns an HTTP client suitable for talking to peers. If
+// tlsConf is nil, the default TLS settings are used.
+func NewPeerClient(tlsConf *tls.Config) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// We only send Expect: 100-continue to other StreiSANd servers, so
+	// there's no need for the fallback for servers which don't support it.
+	// This prevents us from unintentionally sending an internal put to an
+	// overloaded server which didn't respond in 1s.
+	t.ExpectContinueTimeout = 30 * time.Second
+	if tlsConf != nil {
+		t.TLSClientConfig = tlsConf
+	}
+	return &http.Client{Transport: t}
+}
+
+// peerURL returns the URL of path on peer, keeping any path prefix the peer
+// is served under.
+func peerURL(peer *url.URL, path string) string {
+	u := *peer
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
@@ -0,0 +1,65 @@
+package streisand
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPeerURL(t *testing.T) {
+	tests := []struct {
+		peer, path, want string
+	}{
+		{"http://peer:8080", "/internal/upload", "http://peer:8080/internal/upload"},
+		{"https://peer/", "/internal/upload", "https://peer/internal/upload"},
+		{"https://peer/streisand/", "/internal/blob/00", "https://peer/streisand/internal/blob/00"},
+	}
+	for _, tc := range tests {
+		u, err := url.Parse(tc.peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := peerURL(u, tc.path); got != tc.want {
+			t.Errorf("peerURL(%q, %q) = %q, want %q", tc.peer, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestTLSPeers(t *testing.T) {
+	dst := newTestServer(t)
+	hs := httptest.NewTLSServer(dst)
+	defer hs.Close()
+	u, err := url.Parse(hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := NewServer(ServerConfig{
+		DataDir:    t.TempDir(),
+		CacheDir:   t.TempDir(),
+		HTTPClient: hs.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	hash, err := src.(*server).Post(context.Background(), io.NopCloser(strings.NewReader("test")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.(*server).pushBlob(context.Background(), u, hash, "", nil); err != nil {
+		t.Fatalf("pushBlob over TLS: %v", err)
+	}
+	other, err := hex.DecodeString(upload(t, dst, "other test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.(*server).pullBlob(context.Background(), u, other); err != nil {
+		t.Fatalf("pullBlob over TLS: %v", err)
+	}
+}
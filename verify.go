@@ -0,0 +1,142 @@
+package streisand
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+)
+
+// verifiedResponse serves body, which must match digest, through
+// verifiedBody. The response is chunked so that it can carry the trailer.
+func (s *server) verifiedResponse(body io.ReadCloser, hdrs http.Header, algo *HashAlgorithm, digest []byte, local bool) convreq.HttpResponse {
+	hdrs.Del("Content-Length")
+	hdrs.Set("Trailer", "X-StreiSANd-Error")
+	return respond.WithHeaders(respond.Handler(s.verifiedBody(body, algo, digest, local)), hdrs)
+}
+
+// verifiedBody streams body while hashing it with algo, and holds back the
+// last chunk until the hash has been checked. If the contents don't match
+// digest, the client doesn't get that chunk and the X-StreiSANd-Error
+// trailer is set instead. If none of the blob was sent yet, the status is
+// an error as well. A local blob that's corrupt is quarantined and repaired.
+func (s *server) verifiedBody(body io.ReadCloser, algo *HashAlgorithm, digest []byte, local bool) http.Handler {
+	key := algo.key(digest)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer body.Close()
+		h := algo.New()
+		hw := &holdbackWriter{w: w}
+		if _, err := io.Copy(io.MultiWriter(hw, h), body); err != nil {
+			s.logger(r.Context()).Warn("streaming blob failed", "hash", hex.EncodeToString(key), "err", err)
+			panic(http.ErrAbortHandler)
+		}
+		if !bytes.Equal(h.Sum(nil), digest) {
+			// The response ends normally, because an aborted one
+			// would lose the trailer.
+			w.Header().Set(http.TrailerPrefix+"X-StreiSANd-Error", "blob is corrupt")
+			if !hw.sent && local {
+				w.WriteHeader(http.StatusInternalServerError)
+			} else if !hw.sent {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+			if local {
+				s.repairCorrupt(r.Context(), key)
+			} else {
+				s.logger(r.Context()).Warn("peer served a corrupt blob", "hash", hex.EncodeToString(key))
+			}
+			return
+		}
+		if err := hw.flush(); err != nil {
+			s.logger(r.Context()).Debug("streaming blob failed", "hash", hex.EncodeToString(key), "err", err)
+		}
+	})
+}
+
+// verifyingReader hashes what's read from a blob, and returns errHashMismatch
+// instead of io.EOF if the contents don't match digest. It calls corrupt, if
+// set, the first time that happens.
+type verifyingReader struct {
+	io.ReadCloser
+	h       hash.Hash
+	digest  []byte
+	corrupt func()
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.h.Sum(nil), r.digest) {
+		err = errHashMismatch
+		if r.corrupt != nil {
+			r.corrupt()
+			r.corrupt = nil
+		}
+	}
+	return n, err
+}
+
+// holdbackWriter delays every write until the next one, so that the last
+// write is only passed on by flush.
+type holdbackWriter struct {
+	w    io.Writer
+	held []byte
+	// sent is whether anything was passed on.
+	sent bool
+}
+
+func (hw *holdbackWriter) Write(p []byte) (int, error) {
+	if err := hw.flush(); err != nil {
+		return 0, err
+	}
+	hw.held = append(hw.held[:0], p...)
+	return len(p), nil
+}
+
+func (hw *holdbackWriter) flush() error {
+	if len(hw.held) == 0 {
+		return nil
+	}
+	_, err := hw.w.Write(hw.held)
+	hw.held = hw.held[:0]
+	hw.sent = true
+	return err
+}
+
+// repairCorrupt quarantines a blob that was found to be corrupt, and fetches
+// a good copy from a peer in the background.
+func (s *server) repairCorrupt(ctx context.Context, hash []byte) {
+	if err := s.quarantineBlob(ctx, hash); err != nil {
+		s.logger(ctx).Error("quarantining corrupt blob failed", "err", err)
+		return
+	}
+	ctx = detach(ctx)
+	if !s.startBackground() {
+		return
+	}
+	go func() {
+		defer s.background.Done()
+		ctx, cancel := s.stopContext(ctx)
+		defer cancel()
+		if err := s.repairBlob(ctx, hash); err != nil {
+			s.logger(ctx).Error("repairing corrupt blob failed", "hash", hex.EncodeToString(hash), "err", err)
+		}
+	}()
+}
+
+// stopContext returns a context that's cancelled when the server is closed.
+func (s *server) stopContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
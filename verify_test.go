@@ -0,0 +1,235 @@
+package streisand
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func corrupt(t *testing.T, s *server, hash string) {
+	h, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := s.store.FullPath(h)
+	if err := os.Chmod(path, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Repeat("rot", 10000)), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyOnRead(t *testing.T) {
+	peer := newTestServer(t)
+	phs := httptest.NewServer(peer)
+	defer phs.Close()
+
+	srv, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		GetPeers: func() ([]*url.URL, error) {
+			return mustParseURLs(t, phs.URL), nil
+		},
+		VerifyOnRead: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	s := srv.(*server)
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	hash := upload(t, s, "data")
+	upload(t, peer, "data")
+	corrupt(t, s, hash)
+
+	// Small blobs are held back entirely, so the status reports the error.
+	resp, err := http.Get(hs.URL + "/blob/" + hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 500 || len(b) != 0 || resp.Trailer.Get("X-StreiSANd-Error") == "" {
+		t.Fatalf("GET of corrupt blob returned %d %q, trailer %v", resp.StatusCode, b, resp.Trailer)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(hs.URL + "/blob/" + hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil && resp.StatusCode == 200 {
+			if string(b) != "data" {
+				t.Fatalf("GET after repair returned %q", b)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("corrupt blob was never repaired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStoreGetVerifyOnRead(t *testing.T) {
+	peer := newTestServer(t)
+	phs := httptest.NewServer(peer)
+	defer phs.Close()
+
+	srv, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		GetPeers: func() ([]*url.URL, error) {
+			return mustParseURLs(t, phs.URL), nil
+		},
+		VerifyOnRead: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	s := srv.(*server)
+
+	hash := upload(t, s, "data")
+	upload(t, peer, "data")
+	corrupt(t, s, hash)
+	var h Hash
+	hex.Decode(h[:], []byte(hash))
+
+	rc, err := s.Get(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rc); !errors.Is(err, errHashMismatch) {
+		t.Errorf("reading a corrupt blob returned %v", err)
+	}
+	rc.Close()
+
+	// The blob is quarantined and fetched again from the peer.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if has, err := s.Has(h); err != nil {
+			t.Fatal(err)
+		} else if has {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("corrupt blob was never repaired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rc, err = s.Get(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if b, err := ioutil.ReadAll(rc); err != nil || string(b) != "data" {
+		t.Errorf("Get after repair returned %q, %v", b, err)
+	}
+}
+
+func TestVerifyOnReadTrailer(t *testing.T) {
+	peer := newTestServer(t).(*server)
+	phs := httptest.NewServer(peer)
+	defer phs.Close()
+
+	srv, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		GetPeers: func() ([]*url.URL, error) {
+			return mustParseURLs(t, phs.URL), nil
+		},
+		VerifyOnRead: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	s := srv.(*server)
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	// Large blobs are streamed, so only the last chunk is held back. The
+	// one on the peer is served through forwardGetBlob.
+	data := strings.Repeat("x", 1<<20)
+	local := upload(t, s, data+"a")
+	remote := upload(t, peer, data+"b")
+	for _, c := range []struct {
+		s    *server
+		hash string
+	}{{s, local}, {peer, remote}} {
+		path := c.s.store.FullPath(mustDecodeHex(t, c.hash))
+		if err := os.Chmod(path, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data+"c"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, hash := range []string{local, remote} {
+		resp, err := http.Get(hs.URL + "/blob/" + hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 || resp.ContentLength != -1 {
+			t.Errorf("GET %s returned %d with length %d", hash, resp.StatusCode, resp.ContentLength)
+		}
+		if len(b) > len(data) {
+			t.Errorf("GET %s returned all %d bytes of a corrupt blob", hash, len(b))
+		}
+		if got := resp.Trailer.Get("X-StreiSANd-Error"); got != "blob is corrupt" {
+			t.Errorf("GET %s has X-StreiSANd-Error trailer %q", hash, got)
+		}
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPullCorruptBlob(t *testing.T) {
+	peer := newTestServer(t)
+	phs := httptest.NewServer(peer)
+	defer phs.Close()
+	s := newTestServer(t).(*server)
+
+	hash := upload(t, peer, "data")
+	corrupt(t, peer.(*server), hash)
+	h, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.pullBlob(context.Background(), mustParseURLs(t, phs.URL)[0], h); err == nil {
+		t.Fatal("pulling a corrupt blob succeeded")
+	}
+	if n, _, err := s.store.Usage(context.Background()); err != nil || n != 0 {
+		t.Errorf("store has %d blobs after pulling a corrupt blob (err: %v)", n, err)
+	}
+}
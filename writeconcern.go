@@ -0,0 +1,131 @@
+package streisand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// defaultWriteTimeout is how long an upload waits for peers to acknowledge
+// it if the client didn't pass a timeout.
+const defaultWriteTimeout = 30 * time.Second
+
+var errNotEnoughPeers = errors.New("not enough peers to satisfy the write concern")
+
+// writeConcern is the number of copies of an upload that must exist before
+// we respond to the client.
+type writeConcern struct {
+	// copies is the number of copies required, including our own.
+	copies int
+	// all requires every peer that should store the blob to have it.
+	all     bool
+	timeout time.Duration
+}
+
+// parseWriteConcern reads the write concern from the X-StreiSANd-Write-Concern
+// header or w query parameter, which is "local" (the default), the number of
+// copies including the local one, or "all". The time to wait for peers comes
+// from the X-StreiSANd-Write-Timeout header or timeout query parameter.
+func parseWriteConcern(r *http.Request) (writeConcern, error) {
+	wc := writeConcern{copies: 1, timeout: defaultWriteTimeout}
+	v := r.Header.Get("X-StreiSANd-Write-Concern")
+	if v == "" {
+		v = r.URL.Query().Get("w")
+	}
+	switch v {
+	case "", "local":
+	case "all":
+		wc.all = true
+	default:
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return wc, fmt.Errorf("invalid write concern %q", v)
+		}
+		wc.copies = n
+	}
+	t := r.Header.Get("X-StreiSANd-Write-Timeout")
+	if t == "" {
+		t = r.URL.Query().Get("timeout")
+	}
+	if t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil || d <= 0 {
+			return wc, fmt.Errorf("invalid write timeout %q", t)
+		}
+		wc.timeout = d
+	}
+	return wc, nil
+}
+
+// needsPeers returns whether wc can't be satisfied by the local copy alone.
+func (wc writeConcern) needsPeers() bool {
+	return wc.all || wc.copies > 1
+}
+
+// awaitReplicas pushes hash to the peers that should store it until enough of
+// them acknowledged it to satisfy wc, and returns the ones that did. Peers
+// that already had the blob count as acknowledgements too. Our own copy only
+// counts if we own the blob, because otherwise it's handed off. The blob must
+// have been queued in the outbox already, so that peers we don't wait for
+// still get it eventually.
+func (s *server) awaitReplicas(ctx context.Context, hash []byte, namespace string, wc writeConcern) ([]string, error) {
+	targets, err := s.peersFor(hash)
+	if err != nil {
+		return nil, err
+	}
+	owns, err := s.ownsBlob(hash)
+	if err != nil {
+		return nil, err
+	}
+	needed := wc.copies
+	if owns {
+		needed--
+	}
+	if wc.all {
+		needed = len(targets)
+	}
+	if needed > len(targets) {
+		return nil, errNotEnoughPeers
+	}
+	if needed <= 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, wc.timeout)
+	defer cancel()
+	type result struct {
+		peer *url.URL
+		err  error
+	}
+	results := make(chan result, len(targets))
+	for _, t := range targets {
+		go func(t *url.URL) {
+			results <- result{t, s.pushBlob(ctx, t, hash, namespace, nil)}
+		}(t)
+	}
+	var acked []string
+	for range targets {
+		var res result
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			return acked, ctx.Err()
+		}
+		if res.err != nil {
+			s.logger(ctx).Warn("peer didn't acknowledge upload", "peer", res.peer.String(), "err", res.err)
+			continue
+		}
+		if err := s.outbox.remove(res.peer, hash, namespace); err != nil {
+			s.logger(ctx).Error("removing pushed blob from outbox failed", "peer", res.peer.String(), "err", err)
+		}
+		acked = append(acked, res.peer.String())
+		if len(acked) >= needed {
+			return acked, nil
+		}
+	}
+	return acked, fmt.Errorf("only %d of %d peers acknowledged the upload", len(acked), needed)
+}
@@ -0,0 +1,117 @@
+package streisand
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWriteConcern(t *testing.T) {
+	dst := newTestServer(t)
+	hs := httptest.NewServer(dst)
+	defer hs.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	var peers atomic.Value
+	peers.Store(mustParseURLs(t, hs.URL))
+	src, err := NewServer(ServerConfig{
+		DataDir:  t.TempDir(),
+		CacheDir: t.TempDir(),
+		Self:     mustParseURLs(t, "http://src.invalid")[0],
+		GetPeers: func() ([]*url.URL, error) {
+			return append(peers.Load().([]*url.URL), mustParseURLs(t, "http://src.invalid")...), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	post := func(data, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		src.ServeHTTP(w, httptest.NewRequest("POST", "/upload"+query, strings.NewReader(data)))
+		return w
+	}
+
+	w := post("two copies", "?w=2")
+	if w.Code != 200 || w.Header().Get("X-StreiSANd-Acknowledged-By") != hs.URL {
+		t.Fatalf("w=2 returned %d, acknowledged by %q", w.Code, w.Header().Get("X-StreiSANd-Acknowledged-By"))
+	}
+	r := httptest.NewRecorder()
+	dst.ServeHTTP(r, httptest.NewRequest("GET", "/blob/"+w.Body.String(), nil))
+	if r.Code != 200 || r.Body.String() != "two copies" {
+		t.Errorf("peer doesn't have the blob after w=2: %d %q", r.Code, r.Body)
+	}
+
+	// Uploading it again is acknowledged by the peer that already has it.
+	if w := post("two copies", "?w=all"); w.Code != 200 {
+		t.Errorf("w=all for an existing blob returned %d", w.Code)
+	}
+
+	if w := post("three copies", "?w=3"); w.Code != http.StatusServiceUnavailable || w.Body.Len() != 2*BytesPerHash {
+		t.Errorf("w=3 with one peer returned %d: %q", w.Code, w.Body)
+	}
+
+	peers.Store(mustParseURLs(t, down.URL))
+	if w := post("unreachable", "?w=2&timeout=100ms"); w.Code != http.StatusGatewayTimeout || w.Header().Get("X-StreiSANd-Acknowledged-By") != "" {
+		t.Errorf("w=2 with an unavailable peer returned %d", w.Code)
+	}
+
+	if w := post("invalid", "?w=0"); w.Code != http.StatusBadRequest {
+		t.Errorf("w=0 returned %d", w.Code)
+	}
+}
+
+func TestWriteConcernNeedsSelf(t *testing.T) {
+	// Without Self, the server can't tell whether GetPeers returns itself.
+	s := newTestServer(t)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/upload?w=2", strings.NewReader("blob")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("w=2 without Self returned %d", w.Code)
+	}
+}
+
+func TestWriteConcernHandOff(t *testing.T) {
+	owner := newTestServer(t)
+	hs := httptest.NewServer(owner)
+	defer hs.Close()
+	peers := mustParseURLs(t, "http://self.invalid", hs.URL)
+	placement := &Placement{Replicas: 1}
+	s, err := NewServer(ServerConfig{
+		DataDir:   t.TempDir(),
+		CacheDir:  t.TempDir(),
+		Self:      peers[0],
+		GetPeers:  StaticPeers(peers...),
+		Placement: placement,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Our copy of a blob that we don't own is handed off, so it can't
+	// count towards the write concern.
+	data := blobOwnedBy(placement, peers, peers[1])
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/upload?w=2", strings.NewReader(data)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("w=2 with one owner returned %d, acknowledged by %q", w.Code, w.Header().Get("X-StreiSANd-Acknowledged-By"))
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/upload?w=all", strings.NewReader(data)))
+	if w.Code != 200 || w.Header().Get("X-StreiSANd-Acknowledged-By") != hs.URL {
+		t.Fatalf("w=all returned %d, acknowledged by %q", w.Code, w.Header().Get("X-StreiSANd-Acknowledged-By"))
+	}
+	// Once the owner acknowledged it, our copy is handed off.
+	if has, err := s.Has(Hash(sha256.Sum256([]byte(data)))); err != nil || has {
+		t.Errorf("Has after w=all = %v, %v; want it handed off", has, err)
+	}
+}
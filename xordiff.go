@@ -0,0 +1,219 @@
+package streisand
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+)
+
+// maxXorsPerRequest limits the number of entries /internal/xors returns.
+const maxXorsPerRequest = 1 << 12
+
+// diffStep is the number of bits diffXors descends per round trip.
+const diffStep = 4
+
+// maxDiffPrefixes is the number of differing prefixes after which diffXors
+// stops descending.
+const maxDiffPrefixes = 1 << 12
+
+// handleInternalXors returns the xor tree entries of count prefixes of depth
+// bits, starting at prefix number start, as concatenated raw hashes. The
+// X-StreiSANd-Xor-Depth header holds the depth of our tree, which is the
+// deepest the peer can ask for.
+func (s *server) handleInternalXors(r *http.Request) convreq.HttpResponse {
+	if r.Method != "GET" {
+		return respond.MethodNotAllowed("Method Not Allowed")
+	}
+	hs, err := s.hashStoreFor(r)
+	if err != nil {
+		return respond.BadRequest(err.Error())
+	}
+	q := r.URL.Query()
+	depth, err := strconv.ParseUint(q.Get("depth"), 10, 8)
+	if err != nil {
+		return respond.BadRequest("invalid depth")
+	}
+	start, err := strconv.ParseUint(q.Get("start"), 10, 32)
+	if err != nil {
+		return respond.BadRequest("invalid start")
+	}
+	count, err := strconv.ParseUint(q.Get("count"), 10, 32)
+	if err != nil || count > maxXorsPerRequest {
+		return respond.BadRequest("invalid count")
+	}
+	xors, err := hs.xors.XorsAt(uint(depth), uint32(start), uint32(count))
+	if err != nil {
+		return respond.WithHeader(respond.BadRequest(err.Error()), "X-StreiSANd-Xor-Depth", strconv.Itoa(hs.xors.Depth()))
+	}
+	b := make([]byte, 0, len(xors)*BytesPerHash)
+	for _, h := range xors {
+		b = append(b, h[:]...)
+	}
+	return respond.WithHeaders(respond.Bytes(b), http.Header{
+		"Content-Type":          []string{"application/octet-stream"},
+		"X-Streisand-Xor-Depth": []string{strconv.Itoa(hs.xors.Depth())},
+	})
+}
+
+// fetchXors gets entries of the xor tree of peer like XorsAt, and the depth
+// of the peer's tree.
+func (s *server) fetchXors(ctx context.Context, peer *url.URL, hs *hashStore, depth uint, start, count uint32) ([]Hash, uint, error) {
+	u := peerURL(peer, "/internal/xors") + fmt.Sprintf("?hash=%s&depth=%d&start=%d&count=%d", url.QueryEscape(hs.algo.Name), depth, start, count)
+	ctx, cancel := s.peerContext(ctx)
+	defer cancel()
+	req, err := s.newPeerRequest(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, 0, fmt.Errorf("peer returned %s", resp.Status)
+	}
+	peerDepth, err := strconv.ParseUint(resp.Header.Get("X-StreiSANd-Xor-Depth"), 10, 8)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid X-StreiSANd-Xor-Depth from peer: %w", err)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, int64(count)*BytesPerHash+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(b) != int(count)*BytesPerHash {
+		return nil, 0, fmt.Errorf("peer returned %d bytes of xors, want %d", len(b), int(count)*BytesPerHash)
+	}
+	ret := make([]Hash, count)
+	for i := range ret {
+		copy(ret[i][:], b[i*BytesPerHash:])
+	}
+	return ret, uint(peerDepth), nil
+}
+
+// diffXors compares our xor tree of hs with that of peer, and returns the
+// prefixes under which the stores differ. The trees may have different
+// geometries: they're compared down to the depth of the shallower one, which
+// is returned. If more than maxDiffPrefixes prefixes differ, it stops
+// descending and returns the prefixes at the depth it reached. If include
+// isn't nil, prefixes for which it returns false are skipped.
+//
+// It only finds the differences: nothing fetches the blobs under those
+// prefixes yet, so replication still relies on the outbox.
+func (s *server) diffXors(ctx context.Context, peer *url.URL, hs *hashStore, include func(n uint32, depth uint) bool) (uint, []uint32, error) {
+	theirs, peerDepth, err := s.fetchXors(ctx, peer, hs, 0, 0, 1)
+	if err != nil {
+		return 0, nil, err
+	}
+	common := uint(hs.xors.Depth())
+	if peerDepth < common {
+		common = peerDepth
+	}
+	ours, err := hs.xors.XorsAt(0, 0, 1)
+	if err != nil {
+		return 0, nil, err
+	}
+	if ours[0].Equals(&theirs[0]) {
+		return common, nil, nil
+	}
+
+	frontier := []uint32{0}
+	depth := uint(0)
+	for depth < common && len(frontier) <= maxDiffPrefixes {
+		step := uint(diffStep)
+		if depth+step > common {
+			step = common - depth
+		}
+		var next []uint32
+		for _, p := range frontier {
+			start, count := p<<step, uint32(1)<<step
+			theirs, _, err := s.fetchXors(ctx, peer, hs, depth+step, start, count)
+			if err != nil {
+				return 0, nil, err
+			}
+			ours, err := hs.xors.XorsAt(depth+step, start, count)
+			if err != nil {
+				return 0, nil, err
+			}
+			for i := range ours {
+				if ours[i].Equals(&theirs[i]) {
+					continue
+				}
+				if include == nil || include(start+uint32(i), depth+step) {
+					next = append(next, start+uint32(i))
+				}
+			}
+		}
+		frontier = next
+		depth += step
+	}
+	return depth, frontier, nil
+}
+
+// formatPrefix returns the hex digits of prefix number n of depth bits.
+func formatPrefix(n uint32, depth uint) string {
+	h := hashWithPrefix(n, depth)
+	return hex.EncodeToString(h[:])[:(depth+3)/4]
+}
+
+type xorDiff struct {
+	Peer     string   `json:"peer"`
+	Depth    uint     `json:"depth"`
+	Prefixes []string `json:"prefixes"`
+}
+
+// handleDiff compares our xor tree with that of the peer given by the peer
+// query parameter, and lists the hex prefixes under which the stores differ.
+// With a Placement, only the prefixes that both nodes store are compared. It's
+// a diagnostic; the differences aren't repaired.
+func (s *server) handleDiff(r *http.Request) convreq.HttpResponse {
+	if r.Method != "GET" {
+		return respond.MethodNotAllowed("Method Not Allowed")
+	}
+	hs, err := s.hashStoreFor(r)
+	if err != nil {
+		return respond.BadRequest(err.Error())
+	}
+	peer, err := url.Parse(r.URL.Query().Get("peer"))
+	if err != nil {
+		return respond.BadRequest("invalid peer")
+	}
+	// Only talk to actual peers, rather than any URL we're given.
+	var peers []*url.URL
+	if s.conf.GetPeers != nil {
+		if peers, err = s.conf.GetPeers(); err != nil {
+			return respond.Error(err)
+		}
+	}
+	if !containsURL(peers, peer) {
+		return respond.NotFound("unknown peer")
+	}
+	var include func(n uint32, depth uint) bool
+	if p := s.conf.Placement; p != nil {
+		shared := p.SharedPrefixes(peers, s.conf.Self, peer)
+		include = func(n uint32, depth uint) bool {
+			return p.overlapsShared(shared, n, depth)
+		}
+	}
+	depth, prefixes, err := s.diffXors(r.Context(), peer, hs, include)
+	if err != nil {
+		return respond.Error(err)
+	}
+	ret := xorDiff{Peer: peer.String(), Depth: depth, Prefixes: []string{}}
+	for _, p := range prefixes {
+		ret.Prefixes = append(ret.Prefixes, formatPrefix(p, depth))
+	}
+	b, err := json.MarshalIndent(ret, "", "\t")
+	if err != nil {
+		return respond.Error(err)
+	}
+	return respond.WithHeader(respond.Bytes(b), "Content-Type", "application/json")
+}
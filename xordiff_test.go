@@ -0,0 +1,132 @@
+package streisand
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGeometryChange(t *testing.T) {
+	conf := ServerConfig{DataDir: t.TempDir(), CacheDir: t.TempDir(), LayerCount: 3, LayerDepth: 4}
+	s, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for _, b := range []string{"a", "b", "c", "d"} {
+		hashes = append(hashes, upload(t, s, b))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, geometry := range []struct {
+		count, depth  int
+		bitsPerFolder []uint8
+		sparse        bool
+	}{
+		{4, 4, []uint8{4, 4, 4}, false},
+		{2, 4, []uint8{4, 4, 4}, false},
+		{2, 5, []uint8{12}, false},
+		{2, 5, []uint8{12}, true},
+		{3, 4, []uint8{12}, true},
+		{3, 4, []uint8{12}, false},
+	} {
+		conf.LayerCount, conf.LayerDepth, conf.BitsPerFolder = geometry.count, geometry.depth, geometry.bitsPerFolder
+		conf.SparseXors = geometry.sparse
+		s, err := NewServer(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range hashes {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("GET", "/blob/"+h, nil))
+			if w.Code != 200 {
+				t.Errorf("%+v: GET %s returned %d", geometry, h, w.Code)
+			}
+		}
+		xs := s.(*server).xors
+		var want Hash
+		for _, h := range hashes {
+			digest, _ := hex.DecodeString(h)
+			xorHash(digest).XorInto(want[:])
+		}
+		if root, err := xs.XorsAt(0, 0, 1); err != nil || !root[0].Equals(&want) {
+			t.Errorf("%+v: root is %v (%v), want %s", geometry, root, err, want.String())
+		}
+		if xs.RepairTree() != 0 {
+			t.Errorf("%+v: xor tree is inconsistent", geometry)
+		}
+		files, _ := filepath.Glob(filepath.Join(conf.CacheDir, "xors-*"))
+		// The layers, or the sparse snapshot, and the log.
+		wantFiles := geometry.count + 1
+		if geometry.sparse {
+			wantFiles = 2
+		}
+		if len(files) != wantFiles {
+			t.Errorf("%+v: xor files %v", geometry, files)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(conf.CacheDir, xorRebuildMarker)); !os.IsNotExist(err) {
+			t.Errorf("%+v: rebuild marker still exists: %v", geometry, err)
+		}
+	}
+}
+
+func TestDiffXors(t *testing.T) {
+	// a has a deeper tree than b, and one blob that b lacks.
+	a, err := NewServer(ServerConfig{DataDir: t.TempDir(), CacheDir: t.TempDir(), LayerCount: 4, LayerDepth: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	as := httptest.NewServer(a)
+	defer as.Close()
+	b, err := NewServer(ServerConfig{
+		DataDir:    t.TempDir(),
+		CacheDir:   t.TempDir(),
+		LayerCount: 2,
+		LayerDepth: 5,
+		GetPeers:   StaticPeers(mustParseURLs(t, as.URL)...),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for _, data := range []string{"a", "b", "c"} {
+		upload(t, a, data)
+		upload(t, b, data)
+	}
+	extra := upload(t, a, "only on a")
+
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("GET", "/admin/diff?peer="+url.QueryEscape(as.URL), nil))
+	if w.Code != 200 {
+		t.Fatalf("/admin/diff returned %d: %s", w.Code, w.Body)
+	}
+	var diff xorDiff
+	if err := json.Unmarshal(w.Body.Bytes(), &diff); err != nil {
+		t.Fatal(err)
+	}
+	if diff.Depth != 10 {
+		t.Errorf("compared at depth %d, want 10", diff.Depth)
+	}
+	digest, _ := hex.DecodeString(extra)
+	want := formatPrefix(xorHash(digest).PrefixToNumber(10), 10)
+	if len(diff.Prefixes) != 1 || diff.Prefixes[0] != want {
+		t.Errorf("differing prefixes %v, want [%s]", diff.Prefixes, want)
+	}
+
+	w = httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("GET", "/admin/diff?peer="+url.QueryEscape("http://example.com"), nil))
+	if w.Code != 404 {
+		t.Errorf("/admin/diff with an unknown peer returned %d", w.Code)
+	}
+}
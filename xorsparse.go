@@ -0,0 +1,170 @@
+package streisand
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bertha/streisand/diskstore"
+)
+
+// sparseRecordSize is the size of a leaf in a sparse snapshot: the big-endian
+// prefix number and the entry.
+const sparseRecordSize = 4 + BytesPerHash
+
+// sparseLayer holds the entries of a Layer of a Sparse XorStore that aren't
+// zero.
+type sparseLayer struct {
+	mutex   sync.RWMutex
+	entries map[uint32]Hash
+}
+
+func (sl *sparseLayer) get(idx uint32) Hash {
+	sl.mutex.RLock()
+	defer sl.mutex.RUnlock()
+	return sl.entries[idx]
+}
+
+// setLocked must be called with sl.mutex held.
+func (sl *sparseLayer) setLocked(idx uint32, h Hash) {
+	if h.IsZero() {
+		delete(sl.entries, idx)
+	} else {
+		sl.entries[idx] = h
+	}
+}
+
+func (sl *sparseLayer) set(idx uint32, h Hash) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	sl.setLocked(idx, h)
+}
+
+func (sl *sparseLayer) xor(idx uint32, h *Hash) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	e := sl.entries[idx]
+	h.XorInto(e[:])
+	sl.setLocked(idx, e)
+}
+
+// snapshotPath returns the file that the leaves of a Sparse store are written
+// to. It's named after the depth of the leaves, because the layers above
+// them are computed when it's loaded.
+func (s *XorStore) snapshotPath() string {
+	return filepath.Join(s.Path, fmt.Sprintf("xors-%d-sparse", s.Depth()))
+}
+
+// initSparse creates the layers of a Sparse store and loads the snapshot.
+func (s *XorStore) initSparse() error {
+	for i := range s.layers {
+		s.layers[i] = Layer{
+			PrefixLength: uint((i + 1) * s.LayerDepth),
+			Logger:       s.Logger,
+			sparse:       &sparseLayer{entries: map[uint32]Hash{}},
+		}
+	}
+	b, err := ioutil.ReadFile(s.snapshotPath())
+	if os.IsNotExist(err) {
+		for i := range s.layers {
+			s.layers[i].created = true
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(b)%sparseRecordSize != 0 {
+		return fmt.Errorf("%s has size %d, which isn't a multiple of %d", s.snapshotPath(), len(b), sparseRecordSize)
+	}
+	leaves := s.layers[len(s.layers)-1].sparse.entries
+	for i := 0; i < len(b); i += sparseRecordSize {
+		var h Hash
+		copy(h[:], b[i+4:])
+		leaves[binary.BigEndian.Uint32(b[i:])] = h
+	}
+	s.rebuildSparse()
+	return nil
+}
+
+// writeSnapshot writes the leaves of a Sparse store to its snapshot file.
+func (s *XorStore) writeSnapshot() error {
+	leaves := s.layers[len(s.layers)-1].sparse
+	leaves.mutex.RLock()
+	b := make([]byte, len(leaves.entries)*sparseRecordSize)
+	i := 0
+	for idx, h := range leaves.entries {
+		binary.BigEndian.PutUint32(b[i:], idx)
+		copy(b[i+4:], h[:])
+		i += sparseRecordSize
+	}
+	leaves.mutex.RUnlock()
+
+	path := s.snapshotPath()
+	fh, err := ioutil.TempFile(s.Path, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	if _, err := fh.Write(b); err != nil {
+		fh.Close()
+		return err
+	}
+	if s.Fsync {
+		if err := fh.Sync(); err != nil {
+			fh.Close()
+			return err
+		}
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(fh.Name(), path); err != nil {
+		return err
+	}
+	if s.Fsync {
+		return diskstore.SyncDir(s.Path)
+	}
+	return nil
+}
+
+// rebuildSparse recomputes the layers of a Sparse store above the leaves, and
+// returns the number of entries that were wrong.
+func (s *XorStore) rebuildSparse() int {
+	repaired := 0
+	for i := len(s.layers) - 2; i >= 0; i-- {
+		children := s.layers[i+1].sparse
+		fresh := map[uint32]Hash{}
+		children.mutex.RLock()
+		for idx, h := range children.entries {
+			e := fresh[idx>>s.LayerDepth]
+			h.XorInto(e[:])
+			fresh[idx>>s.LayerDepth] = e
+		}
+		children.mutex.RUnlock()
+		for idx, h := range fresh {
+			if h.IsZero() {
+				delete(fresh, idx)
+			}
+		}
+
+		sl := s.layers[i].sparse
+		sl.mutex.Lock()
+		for idx, h := range fresh {
+			if old, ok := sl.entries[idx]; !ok || !old.Equals(&h) {
+				repaired++
+			}
+		}
+		for idx := range sl.entries {
+			if _, ok := fresh[idx]; !ok {
+				repaired++
+			}
+		}
+		sl.entries = fresh
+		sl.mutex.Unlock()
+	}
+	return repaired
+}
@@ -0,0 +1,105 @@
+package streisand
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSparseXorStore(t *testing.T) {
+	dir := t.TempDir()
+	openSparse := func() *XorStore {
+		xs := &XorStore{LayerCount: 3, LayerDepth: 4, Path: dir, Fsync: true, Sparse: true}
+		if err := xs.Initialize(); err != nil {
+			t.Fatal(err)
+		}
+		return xs
+	}
+	dense := newTestXorStore(t, t.TempDir())
+	defer dense.Close()
+	sparse := openSparse()
+	if !sparse.NeedsRebuild() {
+		t.Error("new sparse store doesn't need a rebuild")
+	}
+	if err := sparse.Rebuilt(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := map[Hash]bool{}
+	add := func(h *Hash) {
+		for _, xs := range []*XorStore{dense, sparse} {
+			done, err := xs.Prepare(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			xs.Add(h)
+			done()
+		}
+		stored[*h] = !stored[*h]
+	}
+	for i := 0; i < 1000; i++ {
+		h := Hash(sha256.Sum256([]byte(fmt.Sprint(i))))
+		add(&h)
+	}
+	// Adding hashes again removes them.
+	for i := 0; i < 1000; i += 3 {
+		h := Hash(sha256.Sum256([]byte(fmt.Sprint(i))))
+		add(&h)
+	}
+
+	compare := func(when string) {
+		t.Helper()
+		for depth := uint(0); depth <= uint(dense.Depth()); depth++ {
+			want, err := dense.XorsAt(depth, 0, 1<<depth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := sparse.XorsAt(depth, 0, 1<<depth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for n := range want {
+				if !got[n].Equals(&want[n]) {
+					t.Fatalf("%s: entry %d at depth %d is %s, want %s", when, n, depth, got[n].String(), want[n].String())
+				}
+			}
+		}
+	}
+	compare("before reopening")
+
+	if err := sparse.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sparse = openSparse()
+	if sparse.NeedsRebuild() {
+		t.Error("reopened sparse store needs a rebuild")
+	}
+	compare("after reopening")
+	st, err := os.Stat(sparse.snapshotPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if max := int64(len(stored) * sparseRecordSize); st.Size() > max {
+		t.Errorf("snapshot has %d bytes, want at most %d", st.Size(), max)
+	}
+
+	// Updates since the last snapshot are recovered from the log.
+	h := Hash(sha256.Sum256([]byte("after the snapshot")))
+	add(&h)
+	crash(t, sparse)
+	sparse = openSparse()
+	defer sparse.Close()
+	if _, err := sparse.Recover(func(leaf *Hash) (Hash, error) {
+		var sum Hash
+		for s, ok := range stored {
+			if ok && s.PrefixToNumber(uint(sparse.Depth())) == leaf.PrefixToNumber(uint(sparse.Depth())) {
+				s.XorInto(sum[:])
+			}
+		}
+		return sum, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	compare("after recovering")
+}
@@ -2,12 +2,14 @@ package streisand
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"unsafe"
 
 	"github.com/Jille/errchain"
+	"github.com/bertha/streisand/diskstore"
 )
 
 func (s *XorStore) Add(h *Hash) {
@@ -20,48 +22,352 @@ func (s *XorStore) GetLeaf(h *Hash) Hash {
 	return s.layers[len(s.layers)-1].Get(h)
 }
 
+// XorStore keeps the xors of the hashes of all blobs in a tree of Layers.
+// Updates are logged in a write-ahead log before they're made, see xorWAL.
 type XorStore struct {
 	LayerCount int
 	LayerDepth int
 	Path       string
+	Logger     Logger
+	// Fsync makes Prepare wait until the log is on disk, and checkpoints
+	// msync the layers. Without it, the layers and the log survive a crash
+	// of the process, but not necessarily one of the machine.
+	Fsync bool
+	// Sparse keeps the layers in memory, holding only the entries that
+	// aren't zero, instead of mmapping files of 2^PrefixLength entries, so
+	// that memory and disk use grow with the number of blobs rather than
+	// with the depth. The leaves are written to a snapshot on checkpoints.
+	Sparse bool
 
-	layers []Layer
+	layers  []Layer
+	wal     *xorWAL
+	rebuild bool
 }
 
 func (s *XorStore) Depth() int {
 	return s.LayerCount * s.LayerDepth
 }
 
+// xorRebuildMarker is the file in the Path of an XorStore that exists while
+// its layers need to be rebuilt.
+const xorRebuildMarker = "xors-rebuild"
+
 func (s *XorStore) Initialize() (err error) {
+	if s.LayerCount <= 0 || s.LayerDepth <= 0 || s.Depth() > 32 {
+		return fmt.Errorf("invalid geometry: %d layers of depth %d", s.LayerCount, s.LayerDepth)
+	}
+	ours := map[string]bool{
+		xorRebuildMarker:                         true,
+		fmt.Sprintf("xors-%d-wal", s.LayerDepth): true,
+	}
 	s.layers = make([]Layer, s.LayerCount)
-	for i := range s.layers {
+	if s.Sparse {
+		ours[filepath.Base(s.snapshotPath())] = true
+		if err := s.initSparse(); err != nil {
+			return fmt.Errorf("init sparse layers: %w", err)
+		}
+	} else {
+		for i := 0; i < len(s.layers); i++ {
+			layerName := fmt.Sprintf("xors-%d-layer-%d", s.LayerDepth, i)
+			ours[layerName] = true
+			s.layers[i] = Layer{
+				Path:         filepath.Join(s.Path, layerName),
+				PrefixLength: uint((i + 1) * s.LayerDepth),
+				Logger:       s.Logger,
+			}
+			err = s.layers[i].Initialize()
+			if err != nil {
+				return fmt.Errorf("init layer %d: %w", i, err)
+			}
+		}
+	}
 
-		layerName := fmt.Sprintf("xors-%d-layer-%d", s.LayerDepth, i)
-		s.layers[i] = Layer{
-			Path:         filepath.Join(s.Path, layerName),
-			PrefixLength: uint((i + 1) * s.LayerDepth),
+	// Files of another geometry are left behind when it's changed. The
+	// new layers were created empty, or, if only LayerCount changed, some
+	// of them were kept, so the tree has to be rebuilt either way.
+	stale, err := filepath.Glob(filepath.Join(s.Path, "xors-*"))
+	if err != nil {
+		return err
+	}
+	marker := filepath.Join(s.Path, xorRebuildMarker)
+	if _, err := os.Stat(marker); err == nil {
+		s.rebuild = true
+	}
+	for _, l := range s.layers {
+		if l.created {
+			s.rebuild = true
 		}
-		err = s.layers[i].Initialize()
-		if err != nil {
-			return fmt.Errorf("init layer %d: %w", i, err)
+	}
+	for _, path := range stale {
+		// Leftovers of rewriting the log don't matter.
+		if name := filepath.Base(path); !ours[name] && !strings.Contains(name, "-wal.tmp") {
+			s.rebuild = true
+		}
+	}
+	if s.rebuild {
+		if err := writeMarker(marker, s.Fsync); err != nil {
+			return err
+		}
+	}
+	for _, path := range stale {
+		if ours[filepath.Base(path)] {
+			continue
+		}
+		if s.Logger != nil {
+			s.Logger.Info("removing stale xor file", "path", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
 		}
 	}
 
+	s.wal, err = openXorWAL(filepath.Join(s.Path, fmt.Sprintf("xors-%d-wal", s.LayerDepth)), s.Fsync)
+	if err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+
 	return
 }
 
+// NeedsRebuild returns whether the layers don't describe the store anymore,
+// because they were just created or the geometry changed, and have to be
+// rebuilt with RepairLeaves and RepairTree. It stays true until Rebuilt is
+// called, even across restarts.
+func (s *XorStore) NeedsRebuild() bool {
+	return s.rebuild
+}
+
+// Rebuilt flushes the layers and records that they were rebuilt.
+func (s *XorStore) Rebuilt() error {
+	s.wal.mutex.Lock()
+	defer s.wal.mutex.Unlock()
+	if err := s.checkpoint(); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.Path, xorRebuildMarker)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if s.Fsync {
+		if err := diskstore.SyncDir(s.Path); err != nil {
+			return err
+		}
+	}
+	s.rebuild = false
+	return nil
+}
+
+// Prepare logs that a blob with hash h is about to be added to or removed from
+// the store, which must then be followed by Add if it was. The returned
+// function must be called after that, or when the update was abandoned.
+func (s *XorStore) Prepare(h *Hash) (done func(), err error) {
+	done, err = s.wal.log(h)
+	if err != nil {
+		return nil, err
+	}
+	s.wal.mutex.Lock()
+	defer s.wal.mutex.Unlock()
+	if s.wal.records >= walCheckpointRecords {
+		if err := s.checkpoint(); err != nil {
+			s.wal.finish(*h)
+			return nil, fmt.Errorf("checkpointing xor log: %w", err)
+		}
+	}
+	return done, nil
+}
+
+// checkpoint flushes the layers and drops the finished updates from the log.
+// It must be called with s.wal.mutex held.
+func (s *XorStore) checkpoint() error {
+	if s.Sparse {
+		if err := s.writeSnapshot(); err != nil {
+			return err
+		}
+	} else if s.Fsync {
+		for i := range s.layers {
+			if err := s.layers[i].Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return s.wal.rewrite()
+}
+
+// Recover repairs the updates that were logged but might not have finished
+// before the store was last closed. leaf must return the xor of the hashes of
+// all blobs in the leaf of h, as computed from the store. It returns the
+// number of leaves that were wrong.
+func (s *XorStore) Recover(leaf func(h *Hash) (Hash, error)) (int, error) {
+	s.wal.mutex.Lock()
+	defer s.wal.mutex.Unlock()
+	if len(s.wal.recovered) == 0 {
+		return 0, nil
+	}
+	repaired, err := s.RepairLeaves(s.wal.recovered, leaf)
+	if err != nil {
+		return repaired, err
+	}
+	for _, h := range s.wal.recovered {
+		s.wal.finish(h)
+	}
+	s.wal.recovered = nil
+	return repaired, s.checkpoint()
+}
+
+// RepairLeaves recomputes the leaves of the given hashes with leaf, and their
+// ancestors from their children. It returns the number of leaves that were
+// wrong. It must not be called concurrently with Add.
+func (s *XorStore) RepairLeaves(hashes []Hash, leaf func(h *Hash) (Hash, error)) (int, error) {
+	bottom := &s.layers[len(s.layers)-1]
+	dirty := map[uint32]*Hash{}
+	for i := range hashes {
+		h := &hashes[i]
+		dirty[h.PrefixToNumber(bottom.PrefixLength)] = h
+	}
+	repaired := 0
+	for idx, h := range dirty {
+		want, err := leaf(h)
+		if err != nil {
+			return repaired, err
+		}
+		if got := bottom.get(idx); !want.Equals(&got) {
+			bottom.set(idx, want)
+			repaired++
+		}
+	}
+	for i := len(s.layers) - 2; i >= 0; i-- {
+		parents := map[uint32]bool{}
+		for _, h := range dirty {
+			parents[h.PrefixToNumber(s.layers[i].PrefixLength)] = true
+		}
+		for idx := range parents {
+			s.recompute(i, idx)
+		}
+	}
+	return repaired, nil
+}
+
+// RepairTree recomputes all entries above the leaves from their children,
+// and returns the number of entries that were wrong. It must not be called
+// concurrently with Add.
+func (s *XorStore) RepairTree() int {
+	if s.Sparse {
+		return s.rebuildSparse()
+	}
+	repaired := 0
+	for i := len(s.layers) - 2; i >= 0; i-- {
+		for idx := uint32(0); idx < 1<<s.layers[i].PrefixLength; idx++ {
+			if s.recompute(i, idx) {
+				repaired++
+			}
+		}
+	}
+	return repaired
+}
+
+// recompute sets entry idx of layer i to the xor of its children, and
+// returns whether that changed it.
+func (s *XorStore) recompute(i int, idx uint32) bool {
+	if s.Sparse {
+		var sum Hash
+		for c := uint32(0); c < 1<<s.LayerDepth; c++ {
+			child := s.layers[i+1].get(idx<<s.LayerDepth | c)
+			child.XorInto(sum[:])
+		}
+		if got := s.layers[i].get(idx); got.Equals(&sum) {
+			return false
+		}
+		s.layers[i].set(idx, sum)
+		return true
+	}
+	// This runs for every entry of the tree, so xor whole words.
+	var sum [BytesPerHash / 8]uint64
+	first := s.layers[i+1].entry(idx << s.LayerDepth)
+	children := unsafe.Slice((*uint64)(unsafe.Pointer(&first[0])), len(sum)<<s.LayerDepth)
+	for c := 0; c < len(children); c += len(sum) {
+		for w := range sum {
+			sum[w] ^= children[c+w]
+		}
+	}
+	e := (*[BytesPerHash / 8]uint64)(unsafe.Pointer(&s.layers[i].entry(idx)[0]))
+	if *e == sum {
+		return false
+	}
+	*e = sum
+	return true
+}
+
 func (s *XorStore) Close() (err error) {
-	for _, layer := range s.layers {
-		errchain.Call(&err, layer.Close)
+	if s.wal != nil {
+		s.wal.mutex.Lock()
+		errchain.Call(&err, s.checkpoint)
+		s.wal.mutex.Unlock()
+		errchain.Call(&err, s.wal.close)
+		s.wal = nil
+	}
+	for i := range s.layers {
+		errchain.Call(&err, s.layers[i].Close)
 	}
+	s.layers = nil
 	return
 }
 
+// XorsAt returns the xors of the hashes under count consecutive prefixes of
+// depth bits, starting at prefix number start. depth can be anything up to
+// Depth; between layers, entries are computed from the layer below.
+func (s *XorStore) XorsAt(depth uint, start, count uint32) ([]Hash, error) {
+	if depth > uint(s.Depth()) {
+		return nil, fmt.Errorf("depth %d exceeds the tree's depth of %d", depth, s.Depth())
+	}
+	if uint64(start)+uint64(count) > 1<<depth {
+		return nil, fmt.Errorf("prefixes %d+%d out of range for depth %d", start, count, depth)
+	}
+	var l *Layer
+	for i := range s.layers {
+		if s.layers[i].PrefixLength >= depth {
+			l = &s.layers[i]
+			break
+		}
+	}
+	shift := l.PrefixLength - depth
+	ret := make([]Hash, count)
+	for n := range ret {
+		first := (start + uint32(n)) << shift
+		for c := uint32(0); c < 1<<shift; c++ {
+			e := l.get(first + c)
+			e.XorInto(ret[n][:])
+		}
+	}
+	return ret, nil
+}
+
+// Created returns whether Initialize created all layer files, because the
+// store didn't exist yet or was lost.
+func (s *XorStore) Created() bool {
+	for _, l := range s.layers {
+		if !l.created {
+			return false
+		}
+	}
+	return len(s.layers) > 0
+}
+
+// Initialized returns whether all layers have been mmapped and the store
+// hasn't been closed since.
+func (s *XorStore) Initialized() bool {
+	return s.LayerCount > 0 && len(s.layers) == s.LayerCount
+}
+
 type Layer struct {
+	// Path is the file the layer is mmapped from. It's empty for the
+	// layers of a Sparse store, whose leaves are kept in a snapshot.
 	Path         string
 	PrefixLength uint
+	Logger       Logger
 
 	mmap []byte
+	// sparse holds the entries instead of mmap if the store is Sparse.
+	sparse  *sparseLayer
+	created bool
 }
 
 func (l *Layer) Initialize() (retErr error) {
@@ -98,7 +404,10 @@ func (l *Layer) Initialize() (retErr error) {
 		}
 
 		// file was probably just created, so let us fix its size
-		log.Printf("truncating %v to %d", l.Path, expectedSize)
+		if l.Logger != nil {
+			l.Logger.Info("truncating layer file",
+				"path", l.Path, "size", expectedSize)
+		}
 
 		if err := f.Truncate(int64(expectedSize)); err != nil {
 			return err
@@ -113,6 +422,7 @@ func (l *Layer) Initialize() (retErr error) {
 			return fmt.Errorf("failed to correct size of %s from "+
 				"0 to %d", l.Path, expectedSize)
 		}
+		l.created = true
 	}
 
 	l.mmap, err = syscall.Mmap(int(f.Fd()), 0, expectedSize,
@@ -127,17 +437,56 @@ func (l *Layer) Initialize() (retErr error) {
 }
 
 func (l *Layer) Close() (err error) {
+	if l.sparse != nil {
+		l.sparse = nil
+		return nil
+	}
 	return syscall.Munmap(l.mmap)
 }
 
+// Add xors h into its entry. Entries are shared by blobs under different
+// locks, so they're updated atomically.
 func (l *Layer) Add(h *Hash) {
-	idx := BytesPerHash * h.PrefixToNumber(l.PrefixLength)
-	h.XorInto(l.mmap[idx : idx+BytesPerHash])
+	idx := h.PrefixToNumber(l.PrefixLength)
+	if l.sparse != nil {
+		l.sparse.xor(idx, h)
+		return
+	}
+	h.AtomicXorInto(l.entry(idx))
 }
 
 func (l *Layer) Get(h *Hash) Hash {
-	idx := BytesPerHash * h.PrefixToNumber(l.PrefixLength)
-	return *(*Hash)(l.mmap[idx : idx+BytesPerHash])
+	return l.get(h.PrefixToNumber(l.PrefixLength))
+}
+
+func (l *Layer) get(idx uint32) Hash {
+	if l.sparse != nil {
+		return l.sparse.get(idx)
+	}
+	return atomicLoadHash(l.entry(idx))
+}
+
+func (l *Layer) set(idx uint32, h Hash) {
+	if l.sparse != nil {
+		l.sparse.set(idx, h)
+		return
+	}
+	atomicStoreHash(l.entry(idx), h)
+}
+
+func (l *Layer) entry(idx uint32) []byte {
+	return l.mmap[BytesPerHash*idx : BytesPerHash*(idx+1)]
+}
+
+// Sync writes the changes to an mmapped layer to disk.
+func (l *Layer) Sync() error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&l.mmap[0])), uintptr(len(l.mmap)),
+		syscall.MS_SYNC)
+	if errno != 0 {
+		return fmt.Errorf("msync %s: %w", l.Path, errno)
+	}
+	return nil
 }
 
 var pagesize = os.Getpagesize()
@@ -0,0 +1,143 @@
+package streisand
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bertha/streisand/diskstore"
+)
+
+// walCheckpointRecords is the number of records after which the write-ahead
+// log of an XorStore is checkpointed.
+const walCheckpointRecords = 1 << 14
+
+// xorWAL is the write-ahead log of an XorStore. The hash of a blob is logged
+// before the blob is added to or removed from the store that the XorStore
+// describes, and stays in the log until the layers that include it have been
+// flushed. After a crash it's unknown whether the blob and the layers were
+// updated, so rather than replaying the xors (which isn't idempotent),
+// Recover recomputes the leaves of the logged hashes and their ancestors.
+//
+// The log is a sequence of hashes. Garbage from a torn write only causes an
+// unnecessary recomputation.
+type xorWAL struct {
+	path  string
+	fsync bool
+
+	mutex   sync.Mutex
+	f       *os.File
+	size    int64
+	records int
+	// pending counts the logged hashes whose updates haven't finished.
+	// They're kept when the log is checkpointed.
+	pending map[Hash]int
+	// recovered holds the hashes that were in the log when it was opened.
+	recovered []Hash
+}
+
+func openXorWAL(path string, fsync bool) (*xorWAL, error) {
+	w := &xorWAL{path: path, fsync: fsync, pending: map[Hash]int{}}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for i := 0; i+BytesPerHash <= len(b); i += BytesPerHash {
+		var h Hash
+		copy(h[:], b[i:])
+		if w.pending[h] == 0 {
+			w.recovered = append(w.recovered, h)
+		}
+		w.pending[h]++
+	}
+	if err := w.rewrite(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// log appends h to the log and returns a function that marks its update as
+// finished.
+func (w *xorWAL) log(h *Hash) (done func(), err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, err := w.f.Write(h[:]); err != nil {
+		// Don't leave a partial record behind, which would misalign
+		// the ones after it.
+		w.f.Truncate(w.size)
+		return nil, fmt.Errorf("writing xor log: %w", err)
+	}
+	if w.fsync {
+		if err := w.f.Sync(); err != nil {
+			return nil, fmt.Errorf("syncing xor log: %w", err)
+		}
+	}
+	w.size += BytesPerHash
+	w.records++
+	w.pending[*h]++
+	k := *h
+	return func() {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		w.finish(k)
+	}, nil
+}
+
+// finish must be called with w.mutex held.
+func (w *xorWAL) finish(h Hash) {
+	if w.pending[h]--; w.pending[h] <= 0 {
+		delete(w.pending, h)
+	}
+}
+
+// rewrite replaces the log with one that only holds the pending hashes. It
+// must be called with w.mutex held, after flushing the layers.
+func (w *xorWAL) rewrite() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(w.path), filepath.Base(w.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	for h := range w.pending {
+		if _, err := tmp.Write(h[:]); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if w.fsync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), w.path); err != nil {
+		return err
+	}
+	if w.fsync {
+		if err := diskstore.SyncDir(filepath.Dir(w.path)); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if w.f != nil {
+		w.f.Close()
+	}
+	w.f = f
+	w.records = len(w.pending)
+	w.size = int64(w.records * BytesPerHash)
+	return nil
+}
+
+func (w *xorWAL) close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.f.Close()
+}
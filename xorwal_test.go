@@ -0,0 +1,108 @@
+package streisand
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestXorStore(t *testing.T, dir string) *XorStore {
+	xs := &XorStore{LayerCount: 3, LayerDepth: 4, Path: dir, Fsync: true}
+	if err := xs.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return xs
+}
+
+// crash closes xs without checkpointing its log.
+func crash(t *testing.T, xs *XorStore) {
+	if err := xs.wal.close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range xs.layers {
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestXorStoreRecover(t *testing.T) {
+	dir := t.TempDir()
+	xs := newTestXorStore(t, dir)
+
+	// h1 is added completely. The process crashes after h2 was stored,
+	// but before it was added, and while h3 is only half added.
+	h1, h2, h3 := &Hash{0x12, 1}, &Hash{0x34, 2}, &Hash{0x35, 3}
+	stored := []*Hash{h1, h2, h3}
+	done, err := xs.Prepare(h1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xs.Add(h1)
+	done()
+	if _, err := xs.Prepare(h2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := xs.Prepare(h3); err != nil {
+		t.Fatal(err)
+	}
+	xs.layers[2].Add(h3)
+	crash(t, xs)
+
+	xs = newTestXorStore(t, dir)
+	defer xs.Close()
+	n, err := xs.Recover(func(h *Hash) (Hash, error) {
+		var sum Hash
+		for _, s := range stored {
+			if s.PrefixToNumber(uint(xs.Depth())) == h.PrefixToNumber(uint(xs.Depth())) {
+				s.XorInto(sum[:])
+			}
+		}
+		return sum, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Recover repaired %d leaves, want 1", n)
+	}
+	for _, h := range stored {
+		for i := range xs.layers {
+			var want Hash
+			for _, s := range stored {
+				if s.PrefixToNumber(xs.layers[i].PrefixLength) == h.PrefixToNumber(xs.layers[i].PrefixLength) {
+					s.XorInto(want[:])
+				}
+			}
+			if got := xs.layers[i].Get(h); !got.Equals(&want) {
+				t.Errorf("layer %d entry of %s is %s, want %s", i, h.String(), got.String(), want.String())
+			}
+		}
+	}
+
+	// Recovering again finds nothing to do.
+	if n, err := xs.Recover(nil); err != nil || n != 0 {
+		t.Errorf("second Recover: %d, %v", n, err)
+	}
+}
+
+func TestXorStoreCloseEmptiesLog(t *testing.T) {
+	dir := t.TempDir()
+	xs := newTestXorStore(t, dir)
+	done, err := xs.Prepare(&Hash{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	xs.Add(&Hash{1})
+	done()
+	if err := xs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(filepath.Join(dir, "xors-4-wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != 0 {
+		t.Errorf("log has %d bytes after Close, want 0", st.Size())
+	}
+}